@@ -0,0 +1,316 @@
+package datapackage
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Container names the archive format the files of a package are stored in.
+type Container string
+
+// Container formats. Pack picks ZIP for a PackagePath ending in .zip or
+// .zip.gpg and tar otherwise, unless DataPackage.Container is set. Unpack
+// detects the container from the package contents.
+const (
+	ContainerTar Container = "tar"
+	ContainerZip Container = "zip"
+)
+
+// zipMagic is the signature of a ZIP local file header.
+var zipMagic = []byte{'P', 'K', 0x03, 0x04}
+
+// typeZipSpecial is the tar type flag of ZIP entries for devices, sockets and
+// other special files. ZIP keeps no device numbers, so Unpack refuses them
+// even if devices are allowed.
+const typeZipSpecial = 'Z'
+
+// Unix file type bits of the tar header mode, which give the entries of type
+// typeZipSpecial their type in Entry.Mode.
+const (
+	modeCharDevice  = 020000
+	modeBlockDevice = 060000
+	modeSocket      = 0140000
+)
+
+// maxZipLinkname is the longest symbolic link target read from a ZIP entry.
+const maxZipLinkname = 4096
+
+// archiveWriter writes the entries of a package. *tar.Writer implements it.
+type archiveWriter interface {
+	WriteHeader(hdr *tar.Header) error
+	Write(b []byte) (int, error)
+	Close() error
+}
+
+// archiveReader reads the entries of a package. *tar.Reader implements it.
+type archiveReader interface {
+	Next() (*tar.Header, error)
+	Read(b []byte) (int, error)
+}
+
+// container returns the container Pack writes: Container if it is set, or
+// the one implied by the PackagePath extension.
+func (d *DataPackage) container() Container {
+	if d.Container != "" {
+		return d.Container
+	}
+
+	name := strings.ToLower(d.PackagePath)
+	name = strings.TrimSuffix(name, ".gpg")
+
+	if strings.HasSuffix(name, ".zip") {
+		return ContainerZip
+	}
+
+	return ContainerTar
+}
+
+// zipWriter is an archiveWriter for ZIP packages. ZIP compresses each entry
+// itself, so the package stream is not compressed again.
+type zipWriter struct {
+	w      *zip.Writer
+	cur    io.Writer
+	method uint16
+}
+
+// newZipWriter returns a zipWriter onto w that deflates entries at the given
+// level (0 for the default) for gzip compression, or stores them for none.
+// Other codecs are not supported in ZIP packages.
+func newZipWriter(w io.Writer, c Compression, level int) (*zipWriter, error) {
+	z := &zipWriter{w: zip.NewWriter(w), method: zip.Deflate}
+
+	switch c {
+	case CompressionGzip, "":
+	case CompressionNone:
+		z.method = zip.Store
+	default:
+		return nil, fmt.Errorf("compression '%s' is not supported in zip packages", c)
+	}
+
+	if level != 0 && z.method == zip.Deflate {
+		if _, err := flate.NewWriter(ioutil.Discard, level); err != nil {
+			return nil, err
+		}
+		z.w.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, level)
+		})
+	}
+
+	return z, nil
+}
+
+func (z *zipWriter) WriteHeader(hdr *tar.Header) error {
+	fh, err := zip.FileInfoHeader(hdr.FileInfo())
+	if err != nil {
+		return err
+	}
+
+	fh.Name = filepath.ToSlash(hdr.Name)
+	fh.Method = z.method
+
+	z.cur, err = z.w.CreateHeader(fh)
+	return err
+}
+
+func (z *zipWriter) Write(b []byte) (int, error) {
+	if z.cur == nil {
+		return 0, errors.New("zip: write before header")
+	}
+	return z.cur.Write(b)
+}
+
+func (z *zipWriter) Close() error {
+	return z.w.Close()
+}
+
+// zipReader is an archiveReader for ZIP packages. Directory entries are
+// skipped, as Unpack creates the parent directories of every file. Symbolic
+// links and FIFOs are returned as such, and other special files with type
+// typeZipSpecial.
+type zipReader struct {
+	r    *zip.Reader
+	i    int
+	cur  io.ReadCloser
+	temp *os.File
+}
+
+// newZipReader returns a zipReader for the ZIP archive in r. ZIP keeps its
+// index at the end of the archive, so unless r is a plain package file read
+// in place, it is first copied to a temporary file, within the limits of lim,
+// which is removed once the last entry has been read or the reader is closed.
+func newZipReader(r io.Reader, inPlace *os.File, lim *limiter) (*zipReader, error) {
+	z := new(zipReader)
+
+	f := inPlace
+	if f == nil {
+		var err error
+		if z.temp, err = ioutil.TempFile("", "datapackage-zip-"); err != nil {
+			return nil, err
+		}
+		if _, err = io.Copy(z.temp, &spoolReader{r: r, lim: lim}); err != nil {
+			z.Close()
+			return nil, err
+		}
+		f = z.temp
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		z.Close()
+		return nil, err
+	}
+
+	if z.r, err = zip.NewReader(f, fi.Size()); err != nil {
+		z.Close()
+		return nil, err
+	}
+
+	return z, nil
+}
+
+func (z *zipReader) Next() (*tar.Header, error) {
+	if z.cur != nil {
+		z.cur.Close()
+		z.cur = nil
+	}
+
+	for z.i < len(z.r.File) {
+		f := z.r.File[z.i]
+		z.i++
+
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		z.cur = rc
+
+		hdr := &tar.Header{
+			Name:     f.Name,
+			Mode:     int64(f.Mode().Perm()),
+			Size:     int64(f.UncompressedSize64),
+			ModTime:  f.Modified,
+			Typeflag: tar.TypeReg,
+		}
+
+		// The contents of a symbolic link entry are its target.
+		switch mode := f.Mode(); {
+		case mode&os.ModeSymlink != 0:
+			link, err := ioutil.ReadAll(io.LimitReader(rc, maxZipLinkname+1))
+			if err != nil {
+				return nil, err
+			}
+			if len(link) > maxZipLinkname {
+				return nil, fmt.Errorf("zip: link target of '%s' is too long", f.Name)
+			}
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, string(link), 0
+		case mode&os.ModeNamedPipe != 0:
+			hdr.Typeflag, hdr.Size = tar.TypeFifo, 0
+		case !mode.IsRegular():
+			switch {
+			case mode&os.ModeCharDevice != 0:
+				hdr.Mode |= modeCharDevice
+			case mode&os.ModeDevice != 0:
+				hdr.Mode |= modeBlockDevice
+			case mode&os.ModeSocket != 0:
+				hdr.Mode |= modeSocket
+			}
+			hdr.Typeflag, hdr.Size = typeZipSpecial, 0
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			rc.Close()
+			z.cur = nil
+		}
+
+		return hdr, nil
+	}
+
+	if err := z.Close(); err != nil {
+		return nil, err
+	}
+
+	return nil, io.EOF
+}
+
+func (z *zipReader) Read(b []byte) (int, error) {
+	if z.cur == nil {
+		return 0, io.EOF
+	}
+	return z.cur.Read(b)
+}
+
+// totalSize returns the uncompressed size of all files in the archive other
+// than the manifest.
+func (z *zipReader) totalSize() int64 {
+	var total int64
+	for _, f := range z.r.File {
+		if f.Mode().IsRegular() && f.Name != ManifestName {
+			total += int64(f.UncompressedSize64)
+		}
+	}
+	return total
+}
+
+// Close closes the current entry and removes the temporary copy of the
+// archive, if any. It may be called on a nil or partly built reader.
+func (z *zipReader) Close() error {
+	if z == nil {
+		return nil
+	}
+
+	if z.cur != nil {
+		z.cur.Close()
+		z.cur = nil
+	}
+
+	if z.temp == nil {
+		return nil
+	}
+
+	name := z.temp.Name()
+	err := z.temp.Close()
+	z.temp = nil
+
+	if rerr := os.Remove(name); err == nil {
+		err = rerr
+	}
+
+	return err
+}
+
+// newArchiveReader detects the container of the decompressed package stream
+// in r and returns a reader for its entries. inPlace is the package file if r
+// reads it unchanged (unencrypted and uncompressed), and nil otherwise, and
+// lim limits the copy of a ZIP package that is not read in place.
+func newArchiveReader(r io.Reader, inPlace *os.File, lim *limiter) (archiveReader, error) {
+	br := bufio.NewReader(r)
+
+	magic, err := br.Peek(len(zipMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if bytes.Equal(magic, zipMagic) {
+		z, err := newZipReader(br, inPlace, lim)
+		if err != nil {
+			return nil, err
+		}
+		return z, nil
+	}
+
+	return tar.NewReader(br), nil
+}
@@ -0,0 +1,381 @@
+// Command packer packs directories of CSV files into compressed and optionally
+// encrypted data packages and unpacks those packages into directories.
+//
+// Usage:
+//
+//	packer <command> [flags] [directory]
+//
+// The commands are:
+//
+//	pack    pack the files in directory into a package
+//	unpack  unpack a package into directory (default current directory)
+//	list    list the files in a package
+//	verify  check that a package can be fully read and matches its manifest
+//
+// The package is read from STDIN or written to STDOUT unless -package is
+// given. Run `packer <command> -h` for the flags accepted by each command.
+//
+// Exit codes:
+//
+//	0  success
+//	1  the command failed
+//	2  the command line was invalid
+//	3  the package does not match its manifest, its signature is not trusted,
+//	   or it has unsafe entries or exceeds a limit
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/infomodels/datapackage"
+)
+
+const (
+	exitOK      = 0 // The command succeeded.
+	exitFailure = 1 // The command failed.
+	exitUsage   = 2 // The command line was invalid.
+	exitCorrupt = 3 // The package does not match its manifest, its signature is not trusted, or it has unsafe entries or exceeds a limit.
+)
+
+// command describes a packer subcommand.
+type command struct {
+	summary  string
+	args     string // Usage string for the positional argument.
+	needsDir bool   // Whether the directory argument is required.
+	encrypt  bool   // Whether the command writes a package (and so encrypts).
+	progress bool   // Whether the command can report progress.
+	run      func(d *datapackage.DataPackage, dir string, out io.Writer) error
+}
+
+var commands = map[string]*command{
+	"pack": {
+		summary:  "pack the files in directory into a package",
+		args:     "directory",
+		needsDir: true,
+		encrypt:  true,
+		progress: true,
+		run:      pack,
+	},
+	"unpack": {
+		summary:  "unpack a package into directory (default current directory)",
+		args:     "[directory]",
+		progress: true,
+		run:      unpack,
+	},
+	"list": {
+		summary: "list the files in a package",
+		run:     list,
+	},
+	"verify": {
+		summary: "check that a package can be fully read and matches its manifest",
+		run:     verify,
+	},
+}
+
+// commandOrder is the order in which commands are listed in the usage.
+var commandOrder = []string{"pack", "unpack", "list", "verify"}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run executes the command line in args and returns the exit code.
+func run(args []string, stdout, stderr io.Writer) int {
+
+	if len(args) == 0 {
+		usage(stderr)
+		return exitUsage
+	}
+
+	switch args[0] {
+	case "-h", "-help", "--help", "help":
+		usage(stdout)
+		return exitOK
+	}
+
+	name := args[0]
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "packer: unknown command %q\n", name)
+		usage(stderr)
+		return exitUsage
+	}
+
+	var (
+		d         = new(datapackage.DataPackage)
+		keyServer string
+		keyDir    string
+		wkd       bool
+		progress  bool
+	)
+
+	flags := flag.NewFlagSet("packer "+name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: packer %s [flags] %s\n\n%s.\n\nFlags:\n", name, cmd.args, cmd.summary)
+		flags.PrintDefaults()
+	}
+
+	flags.StringVar(&d.PackagePath, "package", "", "path to the package `file` (default STDIN or STDOUT)")
+	if cmd.encrypt {
+		flags.Var((*stringsFlag)(&d.RecipientKeyPaths), "key", "path to an ASCII-armored public key `file` to encrypt with (repeatable)")
+		flags.Var((*stringsFlag)(&d.RecipientEmails), "email", "`email` of a public key to look up on a keyserver and encrypt with (repeatable)")
+		flags.StringVar(&keyServer, "keyserver", datapackage.DefaultKeyServer, "`URL` of the HKP or HKPS keyserver to look up -email keys on")
+		flags.BoolVar(&wkd, "wkd", false, "look up -email keys in the Web Key Directory of their domain instead")
+		flags.StringVar(&keyDir, "keydir", "", "look up -email keys in a local `directory` of key files instead")
+		flags.StringVar((*string)(&d.Container), "container", "", "archive `format`: tar or zip (default zip for a .zip or .zip.gpg -package, else tar)")
+		flags.StringVar((*string)(&d.Compression), "compression", string(datapackage.CompressionGzip), "compression `codec`: gzip, zstd, xz or none")
+		flags.IntVar(&d.CompressionLevel, "level", 0, "codec-specific compression `level` (default the codec default)")
+		flags.Var((*stringsFlag)(&d.Include), "include", "glob `pattern` of files to pack (repeatable)")
+		flags.Var((*stringsFlag)(&d.Exclude), "exclude", "glob `pattern` of files or directories not to pack (repeatable)")
+		flags.Var((*stringsFlag)(&d.Extensions), "ext", "`extension` of files to pack, e.g. .csv (repeatable; default .csv unless -include is given)")
+		flags.StringVar((*string)(&d.OnUnmatched), "unmatched", string(datapackage.UnmatchedError), "what to do with other files: error, skip or include (`policy`)")
+		flags.BoolVar(&d.WriteDescriptor, "descriptor", false, "add a Frictionless Data Package descriptor (datapackage.json)")
+		flags.BoolVar(&d.Reproducible, "reproducible", false, "write identical packages for identical files, clamping times to SOURCE_DATE_EPOCH")
+		flags.StringVar(&d.SigningKeyPath, "sign", "", "path to an ASCII-armored private key `file` to sign with")
+		flags.StringVar(&d.KeyPassPath, "keypass", "", "path to a `file` holding the signing key passphrase (or set PACKER_KEYPASS)")
+	} else {
+		flags.StringVar(&d.KeyPath, "key", "", "path to an ASCII-armored `file` holding the public and private key to decrypt with")
+		flags.Var((*stringsFlag)(&d.KeyringPaths), "keyring", "path to a `file` or directory of further private keys to decrypt with (repeatable)")
+		flags.StringVar(&d.KeyPassPath, "keypass", "", "path to a `file` holding the private key passphrase (or set PACKER_KEYPASS)")
+		flags.StringVar(&d.KeyPassDir, "keypassdir", "", "path to a `directory` of passphrase files named by key ID (or set PACKER_KEYPASS_<KEYID>)")
+		flags.StringVar(&d.TrustedSignersPath, "trusted", "", "path to an ASCII-armored `file` of trusted signers' public keys; requires a trusted signature")
+		flags.BoolVar(&d.AllowLinks, "allow-links", false, "extract symbolic and hard links that stay inside the directory")
+		flags.BoolVar(&d.AllowDevices, "allow-devices", false, "extract device and FIFO entries")
+		flags.BoolVar(&d.RestoreModTime, "restore-times", false, "give unpacked files and directories their modification times from the package")
+		flags.Var((*modeFlag)(&d.FileMode), "file-mode", "octal permissions `mode` of unpacked files, e.g. 0640 (default from the package)")
+		flags.Var((*modeFlag)(&d.DirMode), "dir-mode", "octal permissions `mode` of unpacked directories, e.g. 0750 (default from the package, else 0755)")
+		flags.BoolVar(&d.RestoreOwner, "restore-owner", false, "give unpacked entries their owner and group from the package (as root)")
+		flags.StringVar((*string)(&d.OnConflict), "conflict", string(datapackage.ConflictFail), "what to do with files that already exist: fail, skip, overwrite, newer or rename (`policy`)")
+		flags.IntVar(&d.Limits.MaxFiles, "max-files", 0, "maximum `number` of entries to extract (default no limit)")
+		flags.Int64Var(&d.Limits.MaxFileSize, "max-file-size", 0, "maximum size of a single file in `bytes` (default no limit)")
+		flags.Int64Var(&d.Limits.MaxTotalSize, "max-total-size", 0, "maximum size of all files in `bytes` (default no limit)")
+		flags.Float64Var(&d.Limits.MaxRatio, "max-ratio", 0, "maximum `ratio` of unpacked to packed bytes (default no limit)")
+	}
+
+	if cmd.progress {
+		flags.BoolVar(&progress, "progress", false, "draw a progress bar on STDERR")
+	}
+
+	if err := flags.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	if flags.NArg() > 1 || (cmd.args == "" && flags.NArg() > 0) {
+		fmt.Fprintf(stderr, "packer %s: too many arguments\n", name)
+		flags.Usage()
+		return exitUsage
+	}
+
+	dir := flags.Arg(0)
+
+	switch {
+	case wkd && keyDir != "":
+		fmt.Fprintf(stderr, "packer %s: -wkd and -keydir are mutually exclusive\n", name)
+		flags.Usage()
+		return exitUsage
+	case wkd:
+		d.KeyResolver = &datapackage.WKDResolver{}
+	case keyDir != "":
+		d.KeyResolver = &datapackage.DirResolver{Dir: keyDir}
+	case keyServer != "":
+		d.KeyResolver = &datapackage.HKPResolver{BaseURL: keyServer}
+	}
+
+	if cmd.needsDir && dir == "" {
+		fmt.Fprintf(stderr, "packer %s: %s is required\n", name, cmd.args)
+		flags.Usage()
+		return exitUsage
+	}
+
+	// Log every file to STDERR, or only warnings if a progress bar is drawn
+	// there.
+	logLevel := slog.LevelInfo
+
+	var bar *progressBar
+	if progress {
+		bar = &progressBar{w: stderr}
+		d.Progress = bar.update
+		logLevel = slog.LevelWarn
+	}
+
+	d.Logger = slog.New(slog.NewTextHandler(stderr, &slog.HandlerOptions{Level: logLevel}))
+
+	err := cmd.run(d, dir, stdout)
+
+	if bar != nil {
+		bar.finish()
+	}
+
+	if err != nil {
+		fmt.Fprintf(stderr, "packer %s: %v\n", name, err)
+
+		var (
+			manifestErr  *datapackage.ManifestError
+			signatureErr *datapackage.SignatureError
+			unsafeErr    *datapackage.UnsafeEntryError
+			limitErr     *datapackage.LimitError
+		)
+		if errors.As(err, &manifestErr) || errors.As(err, &signatureErr) || errors.As(err, &unsafeErr) || errors.As(err, &limitErr) {
+			return exitCorrupt
+		}
+
+		return exitFailure
+	}
+
+	return exitOK
+}
+
+// stringsFlag is a flag.Value that collects every use of a repeatable flag.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// modeFlag is a flag.Value for octal file permissions.
+type modeFlag os.FileMode
+
+func (m *modeFlag) String() string {
+	if *m == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%#o", uint32(*m))
+}
+
+func (m *modeFlag) Set(value string) error {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return fmt.Errorf("invalid permissions %q", value)
+	}
+	*m = modeFlag(mode)
+	return nil
+}
+
+// usage writes the top-level usage message to w.
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "usage: packer <command> [flags] [directory]\n\nCommands:\n")
+	for _, name := range commandOrder {
+		fmt.Fprintf(w, "  %-8s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintf(w, "\nRun `packer <command> -h` for the flags accepted by each command.\n")
+	fmt.Fprintf(w, "\nExit codes:\n  0  success\n  1  the command failed\n  2  the command line was invalid\n  3  the package does not match its manifest, its signature is not trusted, or it has unsafe entries or exceeds a limit\n")
+}
+
+func pack(d *datapackage.DataPackage, dir string, _ io.Writer) error {
+	return d.Pack(dir)
+}
+
+func unpack(d *datapackage.DataPackage, dir string, out io.Writer) error {
+	if err := d.Unpack(dir); err != nil {
+		return err
+	}
+
+	if err := printConflicts(d.Unpacked, out); err != nil {
+		return err
+	}
+
+	return printKeys(d, out)
+}
+
+// printConflicts writes the files that were skipped, overwritten or renamed
+// because they already existed to out.
+func printConflicts(report *datapackage.UnpackReport, out io.Writer) error {
+	for _, name := range report.Skipped {
+		if _, err := fmt.Fprintf(out, "skipped %s\n", name); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range report.Overwritten {
+		if _, err := fmt.Fprintf(out, "overwrote %s\n", name); err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(report.Renamed))
+	for name := range report.Renamed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, err := fmt.Fprintf(out, "renamed %s to %s\n", name, report.Renamed[name]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// printKeys writes the key the package was decrypted with and its verified
+// signer to out, if any.
+func printKeys(d *datapackage.DataPackage, out io.Writer) error {
+	if d.DecryptedBy != nil {
+		if _, err := fmt.Fprintf(out, "decrypted with %s\n", d.DecryptedBy); err != nil {
+			return err
+		}
+	}
+
+	if d.SignedBy != nil {
+		if _, err := fmt.Fprintf(out, "signed by %s\n", d.SignedBy); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// list reads the package without extracting it and writes the mode, size,
+// modification time, SHA-256 digest (from the manifest) and path of each file
+// in it to out.
+func list(d *datapackage.DataPackage, _ string, out io.Writer) error {
+	entries, err := d.List()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		sum := entry.SHA256
+		if sum == "" {
+			sum = "-"
+		}
+
+		if _, err = fmt.Fprintf(out, "%s %12d %s %s  %s\n", entry.Mode, entry.Size, entry.ModTime.Format("2006-01-02 15:04"), sum, entry.Path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// verify reads the package without extracting it, which checks that every
+// layer of the package can be read to the end and that every file matches the
+// manifest.
+func verify(d *datapackage.DataPackage, _ string, out io.Writer) error {
+	if _, err := d.List(); err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintln(out, "package OK"); err != nil {
+		return err
+	}
+
+	return printKeys(d, out)
+}
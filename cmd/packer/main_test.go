@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunUsage(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	tests := []struct {
+		args []string
+		code int
+	}{
+		{nil, exitUsage},
+		{[]string{"-h"}, exitOK},
+		{[]string{"bogus"}, exitUsage},
+		{[]string{"pack"}, exitUsage},
+		{[]string{"pack", "-nope", "dir"}, exitUsage},
+		{[]string{"unpack", "a", "b"}, exitUsage},
+		{[]string{"list", "dir"}, exitUsage},
+		{[]string{"unpack", "-h"}, exitOK},
+	}
+
+	for _, test := range tests {
+		if code := run(test.args, &stdout, &stderr); code != test.code {
+			t.Errorf("packer tests: run(%q) returned %d, want %d", test.args, code, test.code)
+		}
+	}
+}
+
+func TestRunPackUnpackList(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	tmpDir, err := ioutil.TempDir("", "packertest")
+	if err != nil {
+		t.Fatalf("packer tests: can't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dataDir := filepath.Join(tmpDir, "data")
+	if err = os.Mkdir(dataDir, 0755); err != nil {
+		t.Fatalf("packer tests: can't create data directory: %v", err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dataDir, "person.csv"), []byte("id\n1\n"), 0644); err != nil {
+		t.Fatalf("packer tests: error writing temp file: %v", err)
+	}
+
+	packagePath := filepath.Join(tmpDir, "test.tar.gz")
+
+	if code := run([]string{"pack", "-progress", "-package", packagePath, dataDir}, &stdout, &stderr); code != exitOK {
+		t.Fatalf("packer tests: pack returned %d: %s", code, stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "100% [") {
+		t.Fatalf("packer tests: pack -progress drew no complete bar: %q", stderr.String())
+	}
+
+	if code := run([]string{"list", "-package", packagePath}, &stdout, &stderr); code != exitOK {
+		t.Fatalf("packer tests: list returned %d: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "person.csv") {
+		t.Fatalf("packer tests: list output does not name person.csv: %s", stdout.String())
+	}
+
+	if code := run([]string{"verify", "-package", packagePath}, &stdout, &stderr); code != exitOK {
+		t.Fatalf("packer tests: verify returned %d: %s", code, stderr.String())
+	}
+
+	// The total is unknown when unpacking a tar package, so the bar shows how
+	// far each file has got.
+	stderr.Reset()
+	unpackDir := filepath.Join(tmpDir, "unpacked")
+	if code := run([]string{"unpack", "-progress", "-package", packagePath, unpackDir}, &stdout, &stderr); code != exitOK {
+		t.Fatalf("packer tests: unpack returned %d: %s", code, stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "person.csv (100%)") {
+		t.Fatalf("packer tests: unpack -progress did not complete the file: %q", stderr.String())
+	}
+	if _, err = os.Stat(filepath.Join(unpackDir, "person.csv")); err != nil {
+		t.Fatalf("packer tests: person.csv not unpacked: %v", err)
+	}
+
+	if code := run([]string{"verify", "-package", filepath.Join(tmpDir, "missing.tar.gz")}, &stdout, &stderr); code != exitFailure {
+		t.Fatalf("packer tests: verify of missing package returned %d, want %d", code, exitFailure)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/infomodels/datapackage"
+)
+
+// progressWidth is the width of the bar drawn by progressBar.
+const progressWidth = 30
+
+// progressBar draws the progress of a pack or unpack on a single terminal
+// line, redrawing it only when the percentage or the current file changes.
+// Without a total, as when unpacking tar packages, it shows the bytes done and
+// the percentage of the current file (or, if its size is unknown too, redraws
+// for every MiB done).
+type progressBar struct {
+	w     io.Writer
+	step  int64
+	path  string
+	drawn bool
+}
+
+// update redraws the bar for e if it has changed.
+func (p *progressBar) update(e datapackage.ProgressEvent) {
+	var step int64
+	switch {
+	case e.TotalBytes > 0:
+		step = e.Bytes * 100 / e.TotalBytes
+	case e.FileSize > 0:
+		step = e.FileBytes * 100 / e.FileSize
+	default:
+		step = e.Bytes >> 20
+	}
+
+	if p.drawn && step == p.step && e.Path == p.path {
+		return
+	}
+
+	p.step = step
+	p.path = e.Path
+	p.drawn = true
+
+	if e.TotalBytes > 0 {
+		filled := int(step * progressWidth / 100)
+		fmt.Fprintf(p.w, "\r%3d%% [%s%s] %s / %s  %s\x1b[K", step,
+			strings.Repeat("=", filled), strings.Repeat(" ", progressWidth-filled),
+			formatBytes(e.Bytes), formatBytes(e.TotalBytes), e.Path)
+	} else {
+		var file string
+		if e.FileSize > 0 {
+			file = fmt.Sprintf(" (%d%%)", e.FileBytes*100/e.FileSize)
+		}
+		fmt.Fprintf(p.w, "\r%s  %s%s\x1b[K", formatBytes(e.Bytes), e.Path, file)
+	}
+}
+
+// finish ends the line of the bar, if it was drawn.
+func (p *progressBar) finish() {
+	if p.drawn {
+		fmt.Fprintln(p.w)
+	}
+}
+
+// formatBytes formats n bytes with a binary unit, e.g. "1.5 GiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
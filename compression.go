@@ -0,0 +1,127 @@
+package datapackage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression names the codec a package is compressed with.
+type Compression string
+
+// Compression codecs. Pack writes any of them except bzip2, which is only
+// supported for reading. Unpack detects the codec from the magic bytes at the
+// start of the (decrypted) package.
+const (
+	CompressionGzip  Compression = "gzip"
+	CompressionZstd  Compression = "zstd"
+	CompressionXZ    Compression = "xz"
+	CompressionBzip2 Compression = "bzip2"
+	CompressionNone  Compression = "none"
+)
+
+// Magic bytes at the start of each compressed stream.
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	bzip2Magic = []byte("BZh")
+)
+
+// tarMagicOffset is the offset of the "ustar" magic in a tar header.
+const tarMagicOffset = 257
+
+// newCompressor wraps w in a writer that compresses with codec c at the given
+// level, where 0 is the codec default. Levels are 1-9 for gzip and 1-22 for
+// zstd (as for the zstd command line tool), and are ignored for xz and none.
+// An empty codec means gzip.
+func newCompressor(w io.Writer, c Compression, level int) (io.WriteCloser, error) {
+	switch c {
+	case CompressionGzip, "":
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+
+	case CompressionZstd:
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, opts...)
+
+	case CompressionXZ:
+		return xz.NewWriter(w)
+
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+
+	case CompressionBzip2:
+		return nil, fmt.Errorf("bzip2 compression is only supported for reading")
+
+	default:
+		return nil, fmt.Errorf("unsupported compression '%s'", c)
+	}
+}
+
+// newDecompressor detects the codec of the stream in r from its magic bytes
+// and returns a reader that decompresses it, along with the codec. A stream
+// starting with a tar header is returned as is.
+func newDecompressor(r io.Reader) (io.ReadCloser, Compression, error) {
+	br := bufio.NewReaderSize(r, 4096)
+
+	// A short read just means a short (probably invalid) package, which the
+	// tar reader reports.
+	head, err := br.Peek(tarMagicOffset + 5)
+	if err != nil && err != io.EOF {
+		return nil, "", err
+	}
+
+	switch {
+	case len(head) == tarMagicOffset+5 && bytes.HasPrefix(head[tarMagicOffset:], []byte("ustar")):
+		return ioutil.NopCloser(br), CompressionNone, nil
+
+	case bytes.HasPrefix(head, gzipMagic):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, "", err
+		}
+		return zr, CompressionGzip, nil
+
+	case bytes.HasPrefix(head, zstdMagic):
+		zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, "", err
+		}
+		return zr.IOReadCloser(), CompressionZstd, nil
+
+	case bytes.HasPrefix(head, xzMagic):
+		xr, err := xz.NewReader(br)
+		if err != nil {
+			return nil, "", err
+		}
+		return ioutil.NopCloser(xr), CompressionXZ, nil
+
+	case bytes.HasPrefix(head, bzip2Magic):
+		return ioutil.NopCloser(bzip2.NewReader(br)), CompressionBzip2, nil
+
+	default:
+		return ioutil.NopCloser(br), CompressionNone, nil
+	}
+}
+
+// nopWriteCloser adds a no-op Close method to an io.Writer.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
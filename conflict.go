@@ -0,0 +1,72 @@
+package datapackage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ConflictPolicy is what Unpack does with an entry whose path already exists
+// in the target directory. Directories that already exist are always merged
+// into.
+type ConflictPolicy string
+
+// Conflict policies.
+const (
+	ConflictFail      ConflictPolicy = "fail"      // Fail without extracting anything (the default).
+	ConflictSkip      ConflictPolicy = "skip"      // Keep the existing file.
+	ConflictOverwrite ConflictPolicy = "overwrite" // Replace the existing file.
+	ConflictNewer     ConflictPolicy = "newer"     // Replace the existing file if the entry is newer, else keep it.
+	ConflictRename    ConflictPolicy = "rename"    // Extract the entry under a new name with a numeric suffix.
+)
+
+// ConflictError reports the entries of a package whose paths already exist in
+// the target directory, when Unpack is to fail on conflicts.
+type ConflictError struct {
+	Names []string // Names of the conflicting entries, as stored in the package.
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("conflict: %d files already exist, including '%s'", len(e.Names), e.Names[0])
+}
+
+// UnpackReport lists the outcome of every file, link and device Unpack
+// extracted or left out, by slash-separated package path.
+type UnpackReport struct {
+	Created     []string          // Entries that did not exist.
+	Overwritten []string          // Entries that replaced an existing file.
+	Skipped     []string          // Entries left out in favour of an existing file.
+	Renamed     map[string]string // Entries extracted under a new name, to that name.
+}
+
+// conflictPolicy returns the OnConflict policy, checking that it is known.
+func (d *DataPackage) conflictPolicy() (ConflictPolicy, error) {
+	switch d.OnConflict {
+	case "":
+		return ConflictFail, nil
+	case ConflictFail, ConflictSkip, ConflictOverwrite, ConflictNewer, ConflictRename:
+		return d.OnConflict, nil
+	}
+
+	return "", fmt.Errorf("unknown conflict policy '%s'", d.OnConflict)
+}
+
+// renamedPath returns the first of name.1.ext, name.2.ext and so on next to
+// filePath that neither exists nor is taken.
+func renamedPath(filePath string, taken map[string]bool) (string, error) {
+	ext := filepath.Ext(filePath)
+	base := strings.TrimSuffix(filePath, ext)
+
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s.%d%s", base, i, ext)
+		if taken[candidate] {
+			continue
+		}
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+}
@@ -3,11 +3,14 @@
 package datapackage
 
 import (
-	"archive/tar"
-	"compress/gzip"
+	"context"
 	"io"
+	"log/slog"
 	"os"
 	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
 )
 
 // DataPackage represents a compressed and optionally encrypted file that may
@@ -23,27 +26,156 @@ import (
 //
 // PublicKeyEmail is the email associated with a public key uploaded to a key
 // server and can be used in place of KeyPath for encryption. If both are
-// given, KeyPath is used instead.
+// given, KeyPath is used instead. Keys are looked up with KeyResolver, or on
+// the DefaultKeyServer if it is nil.
+//
+// RecipientKeyPaths and RecipientEmails name further public keys, by file or
+// by keyserver email, to encrypt to in addition to KeyPath or PublicKeyEmail.
+// Every key in every given file is a recipient, and any one of their private
+// keys can decrypt the package.
+//
+// KeyringPaths are further files or directories of ASCII-armored or binary
+// private keys for Unpack to decrypt with alongside KeyPath. Only the key the
+// package is encrypted to is unlocked, and Unpack records it in DecryptedBy.
+// Directories are searched for files ending in .asc, .gpg, .key or .pgp.
+//
+// KeyPassPath is the full path to a file holding the password for the key
+// (the decryption key on Unpack or the signing key on Pack). The password can
+// alternatively be exported to the PACKER_KEYPASS environment variable. The
+// environment variable is preferred if both are given.
+//
+// KeyPassDir is the full path to a directory of files holding per-key
+// passwords, each named by the 16 hex digit ID of its key (or of its primary
+// key). A PACKER_KEYPASS_<KEYID> environment variable is preferred over such a
+// file, and KeyPassPath is the fallback for keys without either.
+//
+// Container is the archive format Pack stores files in, tar or ZIP. If it is
+// empty, a PackagePath ending in .zip (or .zip.gpg) means ZIP and anything
+// else tar. Unpack detects the container from the package contents.
+//
+// Compression is the codec Pack compresses the package with, gzip by default,
+// at CompressionLevel (0 for the codec default). Unpack detects the codec from
+// the package contents rather than its file extension. ZIP packages deflate
+// each entry instead (or store it, for CompressionNone), and support no other
+// codec.
+//
+// Include, Exclude and Extensions decide which files Pack packs. Patterns are
+// path.Match globs against the slash-separated path relative to the data
+// directory, or against the base name if they contain no slash, and Exclude
+// patterns ending in a slash match only directories. Excluded files and
+// directories, including those listed in a .packignore file in the data
+// directory, are skipped. Other files are packed if they match an Include
+// pattern or end in one of the Extensions, which are .csv by default, and are
+// otherwise handled according to OnUnmatched: an error by default, skipped
+// with a warning or included anyway.
+//
+// WriteDescriptor makes Pack add a Frictionless Data Package descriptor
+// (datapackage.json) describing each file as a tabular data resource.
+//
+// Reproducible makes Pack write the same bytes for the same files, whatever
+// the system, user and time: files are packed sorted by path, with normalized
+// ownership and permissions and with modification times clamped to
+// SOURCE_DATE_EPOCH, or the Unix epoch if it is not set. Encrypted and signed
+// packages still differ from run to run, as OpenPGP uses random session keys
+// and signature times, but the packages they contain do not.
+//
+// Unpack refuses, with an *UnsafeEntryError, any entry whose path is absolute,
+// leaves the target directory or passes through a symbolic link. It also
+// refuses link entries unless AllowLinks is set, in which case link targets
+// must stay inside the directory as well, and device and FIFO entries unless
+// AllowDevices is set.
+//
+// Limits bounds the number and size of the files Unpack extracts. If a limit
+// is exceeded, Unpack returns a *LimitError and removes the files and
+// directories it created.
+//
+// OnConflict decides what Unpack does with an entry whose path already
+// exists: fail before extracting anything (the default), keep the existing
+// file, replace it, replace it only if the entry is newer, or extract the
+// entry under a new name.
 //
-// KeyPassPath is the full path to a file holding the password for the key.
-// The password can alternatively be exported to the PACKER_KEYPASS environment
-// variable. The environment variable is preferred if both are given.
+// Unpack gives files and directories the permissions they have in the
+// package, regardless of the umask, and directories without an entry 0755.
+// FileMode and DirMode, if set, apply to all files and directories instead.
+// RestoreModTime also restores their modification times, and RestoreOwner
+// their owner and group, which requires running as root and is otherwise
+// ignored.
+//
+// SigningKeyPath is the full path to a file holding an ASCII-armored private
+// key that Pack signs the package with. If no encryption key is given, the
+// package is signed but not encrypted. Unpack recognizes OpenPGP packages by
+// their contents, so a package that is only signed needs no key to unpack.
+//
+// TrustedSignersPath is the full path to a file holding the ASCII-armored
+// public keys of trusted signers. If it is given, Unpack rejects packages that
+// are not signed by one of them with a *SignatureError once the package has
+// been read to the end, and otherwise records the signer in SignedBy.
+//
+// Progress, if set, is called as Pack and Unpack (and a PackageWriter) make
+// progress, at the start of every file and after every chunk of it is
+// written. It is called on the goroutine doing the work, which it delays. The
+// total size of all files is unknown when unpacking tar packages, only that of
+// each file.
+//
+// Logger, if set, receives a record for every file packed, skipped or
+// unpacked, with "file", "size" and "phase" attributes. By default nothing is
+// logged.
 type DataPackage struct {
-	PackagePath    string // Filename of existing or intended data package.
-	KeyPath        string // Path to public key file for encrypting or private key file for decrypting
-	PublicKeyEmail string // Email of public key for lookup on remote keyserver (alternative to KeyPath)
-	KeyPassPath    string // Path to file containing passphrase for the private key
+	PackagePath        string          // Filename of existing or intended data package.
+	KeyPath            string          // Path to public key file for encrypting or private key file for decrypting
+	PublicKeyEmail     string          // Email of public key for lookup on remote keyserver (alternative to KeyPath)
+	RecipientKeyPaths  []string        // Paths to further public key files to encrypt to
+	RecipientEmails    []string        // Emails of further public keys to encrypt to
+	KeyResolver        KeyResolver     // Looks up public keys by email (default HKPS on DefaultKeyServer)
+	KeyringPaths       []string        // Paths to further private key files or directories for decrypting
+	KeyPassPath        string          // Path to file containing passphrase for the private key
+	KeyPassDir         string          // Path to directory of passphrase files named by key ID
+	Container          Container       // Archive format to pack into (default from PackagePath, else tar)
+	Compression        Compression     // Codec to compress with when packing (default gzip)
+	CompressionLevel   int             // Codec-specific compression level, or 0 for the default
+	Include            []string        // Glob patterns of files to pack
+	Exclude            []string        // Glob patterns of files and directories not to pack
+	Extensions         []string        // Extensions of files to pack (default .csv if Include is also empty)
+	OnUnmatched        UnmatchedPolicy // What to do with other files (default UnmatchedError)
+	WriteDescriptor    bool            // Write a datapackage.json descriptor when packing
+	Reproducible       bool            // Write identical packages for identical files
+	AllowLinks         bool            // Extract symbolic and hard link entries that stay inside the directory
+	AllowDevices       bool            // Extract device and FIFO entries (Linux only)
+	Limits             UnpackLimits    // Resource limits for Unpack (default none)
+	OnConflict         ConflictPolicy  // What Unpack does with existing files (default ConflictFail)
+	RestoreModTime     bool            // Give unpacked files and directories their modification times from the package
+	FileMode           os.FileMode     // Permissions of unpacked files (default from the package)
+	DirMode            os.FileMode     // Permissions of unpacked directories (default from the package, else 0755)
+	RestoreOwner       bool            // Give unpacked entries their owner and group from the package, when run as root
+	SigningKeyPath     string          // Path to private key file for signing packages
+	TrustedSignersPath string          // Path to public keyring of signers trusted by Unpack
+
+	Progress func(ProgressEvent) // Called as files are packed or unpacked
+	Logger   *slog.Logger        // Logs files packed and unpacked (default silent)
+
+	// Results of the most recent Unpack
+	SignedBy    *KeyIdentity  // Verified signer of the package, if TrustedSignersPath is given
+	DecryptedBy *KeyIdentity  // Key the package was decrypted with, if it is encrypted
+	Unpacked    *UnpackReport // Outcome of every entry, by conflict policy
 
 	// Working properties
+	ctx             context.Context
 	outWriteCloser  io.WriteCloser
+	tempFile        *os.File
 	encWriteCloser  io.WriteCloser
-	gzipWriteCloser *gzip.Writer
-	tarWriteCloser  *tar.Writer
-	tarReader       *tar.Reader
-	gzipReader      *gzip.Reader
+	compWriteCloser io.WriteCloser
+	archiveWriter   archiveWriter
+	archiveReader   archiveReader
+	compReadCloser  io.ReadCloser
 	encReader       io.Reader
 	inReadCloser    io.ReadCloser
-	keyReader       io.ReadCloser
+	inCounter       *countingReader
+	manifest        *Manifest
+	progress        *progress
+	sourceDate      time.Time
+	descriptor      *Descriptor
+	msgDetails      *openpgp.MessageDetails
+	trustedSigners  openpgp.EntityList
 }
 
 // functions or methods shared by pack and unpack
@@ -59,8 +191,26 @@ func keyReader(keyPath string) (io.Reader, error) {
 	return io.Reader(keyReaderFile), nil
 }
 
+// context returns the context of the current PackContext or UnpackContext, or
+// the background context outside of them.
+func (d *DataPackage) context() context.Context {
+	if d.ctx == nil {
+		return context.Background()
+	}
+	return d.ctx
+}
+
+// logger returns the Logger, or a logger that discards everything if it is
+// nil.
+func (d *DataPackage) logger() *slog.Logger {
+	if d.Logger == nil {
+		return slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	return d.Logger
+}
+
 func (d *DataPackage) gpgInUse() bool {
-	return d.KeyPath != "" || d.PublicKeyEmail != "" || fileNameHasGPG(d.PackagePath)
+	return d.hasRecipients() || d.SigningKeyPath != "" || fileNameHasGPG(d.PackagePath)
 }
 
 // fileNameHasGPG returns true if filename ends in .gpg (case-insensitive)
@@ -2,10 +2,13 @@ package datapackage
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
 	"io/ioutil"
 	"strings"
 	"testing"
 
+	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/openpgp/armor"
 )
 
@@ -13,7 +16,12 @@ import (
 func TestEncrypt(t *testing.T) {
 	in := new(bytes.Buffer)
 
-	encMsg, err := encrypt(in, strings.NewReader(keyRing))
+	recipients, err := openpgp.ReadArmoredKeyRing(strings.NewReader(keyRing))
+	if err != nil {
+		t.Fatalf("packer tests: error reading keyring: %s", err)
+	}
+
+	encMsg, err := encrypt(in, recipients, nil)
 	if err != nil {
 		t.Fatalf("packer tests: error adding encryption: %s", err)
 	}
@@ -24,12 +32,16 @@ func TestEncrypt(t *testing.T) {
 	}
 	encMsg.Close()
 
-	decMsg, err := decrypt(in, strings.NewReader(keyRing), strings.NewReader(keyPass))
+	keyPassphrase := func(openpgp.Key) ([]byte, error) {
+		return []byte(keyPass), nil
+	}
+
+	md, err := readMessage(in, recipients, keyPassphrase, nil)
 	if err != nil {
 		t.Fatalf("packer test: error adding decryption: %s", err)
 	}
 
-	out, err := ioutil.ReadAll(decMsg)
+	out, err := ioutil.ReadAll(md.UnverifiedBody)
 	if err != nil {
 		t.Fatalf("packer test: error decrypting message: %s", err)
 	}
@@ -42,20 +54,28 @@ func TestEncrypt(t *testing.T) {
 
 const testMsg = `A test message`
 
-// TestDecrypt tests the datapackage.decrypt functionality.
+// TestDecrypt tests the datapackage.readMessage functionality.
 func TestDecrypt(t *testing.T) {
-	// Un-armor encrypted message as that's what decrypt expects.
+	// Un-armor encrypted message as that's what readMessage expects.
 	encMsg, err := armor.Decode(strings.NewReader(msgEnc))
 	if err != nil {
 		t.Fatalf("packer tests: error ASCII decoding encrypted message: %s", err)
 	}
 
-	r, err := decrypt(encMsg.Body, strings.NewReader(keyRing), strings.NewReader(keyPass))
+	keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(keyRing))
+	if err != nil {
+		t.Fatalf("packer tests: error reading key ring: %s", err)
+	}
+	keyPassphrase := func(openpgp.Key) ([]byte, error) {
+		return []byte(keyPass), nil
+	}
+
+	md, err := readMessage(encMsg.Body, keyring, keyPassphrase, nil)
 	if err != nil {
 		t.Fatalf("packer tests: error adding decryption: %s", err)
 	}
 
-	newMsgDec, err := ioutil.ReadAll(r)
+	newMsgDec, err := ioutil.ReadAll(md.UnverifiedBody)
 	if err != nil {
 		t.Fatalf("packer tests: error reading from DecryptingReader: %s", err)
 	}
@@ -167,3 +187,109 @@ VshBa17tzRyuUghhz7p1X5rYgbYgqiAMxRPF45HrWmM8yBHt1En7cImNQvXpLEji
 BBTn3w==
 =435b
 -----END PGP PUBLIC KEY BLOCK-----`
+
+// TestManifestVerify tests that Manifest.verify reports mismatched, missing
+// and unlisted files.
+func TestManifestVerify(t *testing.T) {
+	m := &Manifest{Files: []ManifestFile{
+		{Path: "a.csv", Size: 1, SHA256: "aa"},
+		{Path: "b.csv", Size: 2, SHA256: "bb"},
+	}}
+
+	tests := []struct {
+		files    map[string]ManifestFile
+		path     string
+		expected bool
+		actual   bool
+	}{
+		{map[string]ManifestFile{"a.csv": m.Files[0], "b.csv": m.Files[1]}, "", false, false},
+		{map[string]ManifestFile{"a.csv": m.Files[0]}, "b.csv", true, false},
+		{map[string]ManifestFile{"a.csv": m.Files[0], "b.csv": {Path: "b.csv", Size: 2, SHA256: "xx"}}, "b.csv", true, true},
+		{map[string]ManifestFile{"a.csv": m.Files[0], "b.csv": m.Files[1], "c.csv": {Path: "c.csv"}}, "c.csv", false, true},
+	}
+
+	for i, test := range tests {
+		err := m.verify(test.files)
+
+		if test.path == "" {
+			if err != nil {
+				t.Errorf("packer tests: case %d: unexpected error: %v", i, err)
+			}
+			continue
+		}
+
+		manifestErr, ok := err.(*ManifestError)
+		if !ok {
+			t.Errorf("packer tests: case %d: expected *ManifestError, got %v", i, err)
+			continue
+		}
+
+		if manifestErr.Path != test.path || (manifestErr.Expected != nil) != test.expected || (manifestErr.Actual != nil) != test.actual {
+			t.Errorf("packer tests: case %d: unexpected error %v", i, manifestErr)
+		}
+	}
+}
+
+// TestZBase32 tests zbase32 against the Web Key Directory specification
+// example for "Joe.Doe@Example.ORG".
+func TestZBase32(t *testing.T) {
+	hash := sha1.Sum([]byte("joe.doe"))
+
+	if got := zbase32(hash[:]); got != "iy9q119eutrkn8s1mk4r39qejnbu3n5q" {
+		t.Fatalf("packer tests: zbase32 returned %s", got)
+	}
+}
+
+// testMsgBzip2 is testMsg compressed with bzip2, which can only be read.
+const testMsgBzip2 = "425a683931415926535992da65b500000115804000200022820c002000220d19a8430205c4183958bc5dc914e142424b6996d4"
+
+// TestDecompressorDetection tests that newDecompressor picks the codec from
+// the magic bytes of streams written by newCompressor.
+func TestDecompressorDetection(t *testing.T) {
+	for _, c := range []Compression{CompressionGzip, CompressionZstd, CompressionXZ, CompressionNone} {
+		buf := new(bytes.Buffer)
+
+		w, err := newCompressor(buf, c, 0)
+		if err != nil {
+			t.Fatalf("packer tests: %s: error creating compressor: %v", c, err)
+		}
+		if _, err = w.Write([]byte(testMsg)); err != nil {
+			t.Fatalf("packer tests: %s: error writing message: %v", c, err)
+		}
+		if err = w.Close(); err != nil {
+			t.Fatalf("packer tests: %s: error closing compressor: %v", c, err)
+		}
+
+		testDecompress(t, buf.Bytes(), c)
+	}
+
+	b, err := hex.DecodeString(testMsgBzip2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDecompress(t, b, CompressionBzip2)
+
+	if _, err = newCompressor(ioutil.Discard, CompressionBzip2, 0); err == nil {
+		t.Fatalf("packer tests: expected an error compressing with bzip2")
+	}
+}
+
+func testDecompress(t *testing.T, b []byte, expected Compression) {
+	r, c, err := newDecompressor(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("packer tests: %s: error creating decompressor: %v", expected, err)
+	}
+	defer r.Close()
+
+	if c != expected {
+		t.Fatalf("packer tests: detected %s, expected %s", c, expected)
+	}
+
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("packer tests: %s: error decompressing: %v", expected, err)
+	}
+	if string(out) != testMsg {
+		t.Fatalf("packer tests: %s: round-trip message (%s) does not equal original (%s)", expected, out, testMsg)
+	}
+}
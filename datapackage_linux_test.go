@@ -0,0 +1,136 @@
+package datapackage_test
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/infomodels/datapackage"
+)
+
+// TestFileHandles packs and unpacks thousands of files with few file
+// descriptors available, which fails if a file is left open per entry.
+func TestFileHandles(t *testing.T) {
+	const files = 3000
+
+	te := NewTestEnv(t, false)
+	defer te.RemoveTestFiles(t)
+
+	for i := 0; i < files; i++ {
+		name := filepath.Join(te.DataDir, fmt.Sprintf("table%04d.csv", i))
+		if err := ioutil.WriteFile(name, []byte(testMsg), 0644); err != nil {
+			t.Fatalf("packer tests: error writing temp file: %v", err)
+		}
+	}
+
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		t.Fatalf("packer tests: error getting file limit: %v", err)
+	}
+
+	low := limit
+	low.Cur = 128
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &low); err != nil {
+		t.Skipf("packer tests: cannot lower file limit: %v", err)
+	}
+	defer syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limit)
+
+	d := &datapackage.DataPackage{PackagePath: te.PackagePath}
+	if err := d.Pack(te.DataDir); err != nil {
+		t.Fatalf("packer tests: error packing file: %v", err)
+	}
+
+	if err := d.Unpack(te.UnpackDataDir); err != nil {
+		t.Fatalf("packer tests: error unpacking file: %v", err)
+	}
+
+	te.VerifyUnpack(t)
+
+	entries, err := ioutil.ReadDir(te.UnpackDataDir)
+	if err != nil {
+		t.Fatalf("packer tests: error reading unpacked directory: %v", err)
+	}
+	if len(entries) != files+2 {
+		t.Fatalf("packer tests: unpacked %d files, want %d", len(entries), files+2)
+	}
+
+	// Every layer is closed after a failed Unpack, too.
+	failing := &datapackage.DataPackage{PackagePath: te.PackagePath, Limits: datapackage.UnpackLimits{MaxFiles: 1}}
+	for i := 0; i < 2*int(low.Cur); i++ {
+		if err = failing.Unpack(filepath.Join(te.UnpackDataDir, "failing")); err == nil {
+			t.Fatalf("packer tests: expected a limit error")
+		}
+	}
+	if err = d.Unpack(filepath.Join(te.UnpackDataDir, "again")); err != nil {
+		t.Fatalf("packer tests: error unpacking file after failures: %v", err)
+	}
+}
+
+// TestFailedDirTimes unpacks into a shared directory owned by someone else,
+// whose modification time cannot be restored, which must roll the Unpack back
+// with the files it overwrote intact.
+func TestFailedDirTimes(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("packer tests: root can set the times of any directory")
+	}
+
+	target := os.TempDir()
+	var st syscall.Stat_t
+	if err := syscall.Stat(target, &st); err != nil || int(st.Uid) == os.Getuid() {
+		t.Skipf("packer tests: %s is not owned by another user", target)
+	}
+
+	f, err := ioutil.TempFile(target, "datapackage-*.csv")
+	if err != nil {
+		t.Skipf("packer tests: cannot write to %s: %v", target, err)
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.WriteString("old"); err != nil {
+		t.Fatalf("packer tests: error writing temp file: %v", err)
+	}
+	f.Close()
+
+	te := NewTestEnv(t, false)
+	defer te.RemoveTestFiles(t)
+
+	pkgPath := filepath.Join(te.PackageDir, "times.tar.gz")
+	writeTestEntries(t, pkgPath, []*tar.Header{
+		{Name: "./", Typeflag: tar.TypeDir, Mode: 0755, ModTime: time.Date(2002, 3, 4, 5, 6, 7, 0, time.UTC)},
+		{Name: filepath.Base(f.Name()), Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(testMsg))},
+	}, []string{"", testMsg})
+
+	d := &datapackage.DataPackage{PackagePath: pkgPath, OnConflict: datapackage.ConflictOverwrite, RestoreModTime: true}
+	if err = d.Unpack(target); err == nil {
+		t.Fatalf("packer tests: expected an error restoring the time of %s", target)
+	}
+	if content, _ := ioutil.ReadFile(f.Name()); string(content) != "old" {
+		t.Fatalf("packer tests: overwritten file not restored, has %q", content)
+	}
+}
+
+// TestPackUmask packs with a restrictive umask, which the package file must
+// be subject to like any other file created.
+func TestPackUmask(t *testing.T) {
+	te := NewTestEnv(t, false)
+	defer te.RemoveTestFiles(t)
+
+	defer syscall.Umask(syscall.Umask(077))
+
+	d := &datapackage.DataPackage{PackagePath: te.PackagePath}
+	if err := d.Pack(te.DataDir); err != nil {
+		t.Fatalf("packer tests: error packing file: %v", err)
+	}
+
+	fi, err := os.Stat(te.PackagePath)
+	if err != nil {
+		t.Fatalf("packer tests: error reading package: %v", err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("packer tests: package has mode %v, want 0600", fi.Mode().Perm())
+	}
+}
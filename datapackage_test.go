@@ -1,12 +1,36 @@
 package datapackage_test
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/infomodels/datapackage"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
 )
 
 const testMsg = `A test message`
@@ -95,6 +119,9 @@ func (te *TestEnv) VerifyUnpack(t *testing.T) {
 	if err != nil || string(content) != testMsg {
 		t.Fatalf("packer tests: datafile2.csv not successfully unpacked")
 	}
+	if _, err = os.Stat(filepath.Join(te.UnpackDataDir, datapackage.ManifestName)); !os.IsNotExist(err) {
+		t.Fatalf("packer tests: manifest unexpectedly extracted")
+	}
 }
 
 func (te *TestEnv) RemoveTestFiles(t *testing.T) {
@@ -129,7 +156,11 @@ func testPacker(t *testing.T, gpg bool, gpgLocalPublic bool) {
 			d.KeyPath = te.PublicKeyFilePath
 			// d.KeyPath will have to be changed prior to the Unpack operation to point to the private key
 		} else {
+			keyServer := newTestKeyServer(t)
+			defer keyServer.Close()
+
 			d.PublicKeyEmail = "testy@test.er"
+			d.KeyResolver = &datapackage.HKPResolver{BaseURL: keyServer.URL}
 		}
 	}
 
@@ -156,30 +187,1714 @@ func TestPacker(t *testing.T) {
 
 	testPacker(t, false, false) // test Pack and Unpack with no gpg
 	testPacker(t, true, true)   // test Pack and Unpack with a local public gpg key file (KeyPath)
-	testPacker(t, true, false)  // test Pack and Unpack with a lookup of a public key from a keyserver
+	testPacker(t, true, false)  // test Pack and Unpack with a lookup of a public key from a (stand-in) keyserver
 }
 
-func ExampleDataPackage_Pack() {
-	d := &datapackage.DataPackage{
-		PackagePath:    "/home/user/datapackage.tar.gz.gpg",
-		PublicKeyEmail: "testy@test.er",
+// writeTestPackage writes a .tar.gz package holding the given files, in order,
+// to path.
+func writeTestPackage(t *testing.T, path string, files [][2]string) {
+	hdrs := make([]*tar.Header, len(files))
+	contents := make([]string, len(files))
+
+	for i, file := range files {
+		hdrs[i] = &tar.Header{Name: file[0], Mode: 0644, Size: int64(len(file[1])), Typeflag: tar.TypeReg}
+		contents[i] = file[1]
 	}
 
-	d.Pack("/home/user/datadirectory")
+	writeTestEntries(t, path, hdrs, contents)
 }
 
-func ExampleDataPackage_Unpack() {
-	d := &datapackage.DataPackage{
-		PackagePath: "/home/user/datapackage.tar.gz.gpg",
-		KeyPath:     "/home/user/keys/public_and_private.asc",
-		KeyPassPath: "/home/user/keys/pass.txt",
+// writeTestEntries writes a gzipped tar package with the given headers and
+// contents of each entry, without a manifest.
+func writeTestEntries(t *testing.T, path string, hdrs []*tar.Header, contents []string) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("packer tests: can't create package: %v", err)
 	}
+	defer f.Close()
 
-	d.Unpack("/home/user/datadirectory")
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+
+	for i, hdr := range hdrs {
+		if err = tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("packer tests: error writing tar header: %v", err)
+		}
+		if _, err = tw.Write([]byte(contents[i])); err != nil {
+			t.Fatalf("packer tests: error writing tar entry: %v", err)
+		}
+	}
+
+	if err = tw.Close(); err != nil {
+		t.Fatalf("packer tests: error closing tar writer: %v", err)
+	}
+	if err = gw.Close(); err != nil {
+		t.Fatalf("packer tests: error closing gzip writer: %v", err)
+	}
 }
 
-// Email address used for test key pair below
-const testKeyEmail = "testy@test.er"
+// writeTestZipEntries writes a ZIP package with the given headers and
+// contents of each entry, without a manifest. Link targets are stored as the
+// contents of link entries, as ZIP does.
+func writeTestZipEntries(t *testing.T, path string, hdrs []*tar.Header, contents []string) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("packer tests: can't create package: %v", err)
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+
+	for i, hdr := range hdrs {
+		fh, err := zip.FileInfoHeader(hdr.FileInfo())
+		if err != nil {
+			t.Fatalf("packer tests: error making zip header: %v", err)
+		}
+		fh.Name = hdr.Name
+
+		w, err := zw.CreateHeader(fh)
+		if err != nil {
+			t.Fatalf("packer tests: error writing zip header: %v", err)
+		}
+		if _, err = w.Write([]byte(contents[i] + hdr.Linkname)); err != nil {
+			t.Fatalf("packer tests: error writing zip entry: %v", err)
+		}
+	}
+
+	if err = zw.Close(); err != nil {
+		t.Fatalf("packer tests: error closing zip writer: %v", err)
+	}
+}
+
+func TestUnpackManifestMismatch(t *testing.T) {
+	te := NewTestEnv(t, false)
+	defer te.RemoveTestFiles(t)
+
+	manifest, _ := json.Marshal(&datapackage.Manifest{
+		Files: []datapackage.ManifestFile{
+			{Path: "datafile1.csv", Size: int64(len(testMsg)), SHA256: "0000"},
+		},
+	})
+
+	writeTestPackage(t, te.PackagePath, [][2]string{
+		{"datafile1.csv", testMsg},
+		{datapackage.ManifestName, string(manifest)},
+	})
+
+	d := &datapackage.DataPackage{PackagePath: te.PackagePath}
+
+	err := d.Unpack(te.UnpackDataDir)
+
+	manifestErr, ok := err.(*datapackage.ManifestError)
+	if !ok {
+		t.Fatalf("packer tests: expected *ManifestError, got %v", err)
+	}
+	if manifestErr.Path != "datafile1.csv" {
+		t.Fatalf("packer tests: ManifestError names %s, expected datafile1.csv", manifestErr.Path)
+	}
+}
+
+func TestUnsafeEntries(t *testing.T) {
+	te := NewTestEnv(t, false)
+	defer te.RemoveTestFiles(t)
+
+	file := func(name string) *tar.Header {
+		return &tar.Header{Name: name, Mode: 0644, Size: int64(len(testMsg)), Typeflag: tar.TypeReg}
+	}
+	link := func(typeflag byte, name, target string) *tar.Header {
+		return &tar.Header{Name: name, Linkname: target, Mode: 0777, Typeflag: typeflag}
+	}
+
+	cases := []struct {
+		hdrs       []*tar.Header
+		allowLinks bool
+		expected   error
+	}{
+		{[]*tar.Header{file("../evil.csv")}, false, datapackage.ErrPathTraversal},
+		{[]*tar.Header{file("a/../../evil.csv")}, false, datapackage.ErrPathTraversal},
+		{[]*tar.Header{file("/tmp/evil.csv")}, false, datapackage.ErrPathTraversal},
+		{[]*tar.Header{link(tar.TypeSymlink, "etc", "/etc")}, false, datapackage.ErrLinkEntry},
+		{[]*tar.Header{link(tar.TypeLink, "passwd", "datafile1.csv")}, false, datapackage.ErrLinkEntry},
+		{[]*tar.Header{link(tar.TypeSymlink, "etc", "/etc")}, true, datapackage.ErrPathTraversal},
+		{[]*tar.Header{link(tar.TypeSymlink, "a/up", "../..")}, true, datapackage.ErrPathTraversal},
+		{[]*tar.Header{link(tar.TypeLink, "passwd", "../passwd")}, true, datapackage.ErrPathTraversal},
+		{[]*tar.Header{link(tar.TypeSymlink, "a", "b"), file("a/evil.csv")}, true, datapackage.ErrPathTraversal},
+		{[]*tar.Header{{Name: "null", Mode: 0666, Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3}}, true, datapackage.ErrSpecialEntry},
+	}
+
+	// check unpacks the package at path, written by write with the entries
+	// hdrs, and expects an *UnsafeEntryError for the last of them.
+	check := func(name string, write func(*testing.T, string, []*tar.Header, []string), path string, hdrs []*tar.Header, d *datapackage.DataPackage, expected error) {
+		os.RemoveAll(te.UnpackDataDir)
+
+		contents := make([]string, len(hdrs))
+		for j, hdr := range hdrs {
+			if hdr.Typeflag == tar.TypeReg {
+				contents[j] = testMsg
+			}
+		}
+
+		write(t, path, hdrs, contents)
+
+		d.PackagePath = path
+		err := d.Unpack(te.UnpackDataDir)
+
+		var unsafeErr *datapackage.UnsafeEntryError
+		if !errors.As(err, &unsafeErr) || !errors.Is(err, expected) {
+			t.Fatalf("packer tests: %s: expected *UnsafeEntryError wrapping %v, got %v", name, expected, err)
+		}
+		if unsafeErr.Name != hdrs[len(hdrs)-1].Name {
+			t.Fatalf("packer tests: %s: UnsafeEntryError names %s", name, unsafeErr.Name)
+		}
+
+		if _, err = os.Lstat(filepath.Join(te.UnpackDataDir, "..", "evil.csv")); !os.IsNotExist(err) {
+			t.Fatalf("packer tests: %s: file written outside the directory", name)
+		}
+	}
+
+	for i, c := range cases {
+		d := &datapackage.DataPackage{AllowLinks: c.allowLinks}
+		check("case "+strconv.Itoa(i), writeTestEntries, te.PackagePath, c.hdrs, d, c.expected)
+	}
+
+	// ZIP packages carry symbolic links and special files in the entry mode.
+	// They keep no device numbers, so devices are refused even if allowed.
+	zipCases := []struct {
+		hdrs         []*tar.Header
+		allowLinks   bool
+		allowDevices bool
+		expected     error
+	}{
+		{[]*tar.Header{file("../evil.csv")}, false, false, datapackage.ErrPathTraversal},
+		{[]*tar.Header{link(tar.TypeSymlink, "passwd", "/etc/passwd")}, false, false, datapackage.ErrLinkEntry},
+		{[]*tar.Header{link(tar.TypeSymlink, "passwd", "/etc/passwd")}, true, false, datapackage.ErrPathTraversal},
+		{[]*tar.Header{link(tar.TypeSymlink, "a", "b"), file("a/evil.csv")}, true, false, datapackage.ErrPathTraversal},
+		{[]*tar.Header{{Name: "fifo", Mode: 0644, Typeflag: tar.TypeFifo}}, false, false, datapackage.ErrSpecialEntry},
+		{[]*tar.Header{{Name: "null", Mode: 0666, Typeflag: tar.TypeChar}}, false, true, datapackage.ErrSpecialEntry},
+	}
+
+	for i, c := range zipCases {
+		d := &datapackage.DataPackage{AllowLinks: c.allowLinks, AllowDevices: c.allowDevices}
+		check("zip case "+strconv.Itoa(i), writeTestZipEntries, filepath.Join(te.PackageDir, "test.zip"), c.hdrs, d, c.expected)
+	}
+
+	// Links that stay inside the directory are extracted when allowed.
+	os.RemoveAll(te.UnpackDataDir)
+
+	writeTestEntries(t, te.PackagePath, []*tar.Header{
+		file("data/datafile1.csv"),
+		link(tar.TypeSymlink, "data/latest.csv", "datafile1.csv"),
+		link(tar.TypeLink, "copy.csv", "data/datafile1.csv"),
+	}, []string{testMsg, "", ""})
+
+	d := &datapackage.DataPackage{PackagePath: te.PackagePath, AllowLinks: true}
+	if err := d.Unpack(te.UnpackDataDir); err != nil {
+		t.Fatalf("packer tests: error unpacking links: %v", err)
+	}
+
+	for _, name := range []string{"data/latest.csv", "copy.csv"} {
+		content, err := ioutil.ReadFile(filepath.Join(te.UnpackDataDir, name))
+		if err != nil || string(content) != testMsg {
+			t.Fatalf("packer tests: link %s not successfully unpacked: %v", name, err)
+		}
+	}
+
+	// So are symbolic links in ZIP packages, as links.
+	os.RemoveAll(te.UnpackDataDir)
+
+	zipPath := filepath.Join(te.PackageDir, "test.zip")
+	writeTestZipEntries(t, zipPath, []*tar.Header{
+		file("data/datafile1.csv"),
+		link(tar.TypeSymlink, "data/latest.csv", "datafile1.csv"),
+	}, []string{testMsg, ""})
+
+	d = &datapackage.DataPackage{PackagePath: zipPath, AllowLinks: true}
+	if err := d.Unpack(te.UnpackDataDir); err != nil {
+		t.Fatalf("packer tests: error unpacking zip links: %v", err)
+	}
+
+	if target, err := os.Readlink(filepath.Join(te.UnpackDataDir, "data", "latest.csv")); err != nil || target != "datafile1.csv" {
+		t.Fatalf("packer tests: zip link not unpacked as a link: %q, %v", target, err)
+	}
+}
+
+func TestUnpackLimits(t *testing.T) {
+	te := NewTestEnv(t, false)
+	defer te.RemoveTestFiles(t)
+
+	d := &datapackage.DataPackage{PackagePath: te.PackagePath}
+	if err := d.Pack(te.DataDir); err != nil {
+		t.Fatalf("packer tests: error packing file: %v", err)
+	}
+
+	cases := []struct {
+		limits datapackage.UnpackLimits
+		limit  string
+	}{
+		{datapackage.UnpackLimits{MaxFiles: 1}, "MaxFiles"},
+		{datapackage.UnpackLimits{MaxFileSize: int64(len(testMsg)) - 1}, "MaxFileSize"},
+		{datapackage.UnpackLimits{MaxTotalSize: int64(len(testMsg)) + 1}, "MaxTotalSize"},
+	}
+
+	for _, c := range cases {
+		unpackDir := filepath.Join(te.UnpackDataDir, "out")
+
+		d = &datapackage.DataPackage{PackagePath: te.PackagePath, Limits: c.limits}
+
+		err := d.Unpack(unpackDir)
+
+		var limitErr *datapackage.LimitError
+		if !errors.As(err, &limitErr) || limitErr.Limit != c.limit {
+			t.Fatalf("packer tests: expected *LimitError for %s, got %v", c.limit, err)
+		}
+
+		if _, err = os.Stat(unpackDir); !os.IsNotExist(err) {
+			t.Fatalf("packer tests: %s: partial unpack not removed", c.limit)
+		}
+	}
+
+	// Generous limits are not exceeded.
+	d = &datapackage.DataPackage{PackagePath: te.PackagePath, Limits: datapackage.UnpackLimits{MaxFiles: 2, MaxFileSize: 1024, MaxTotalSize: 2048, MaxRatio: 10}}
+	if err := d.Unpack(te.UnpackDataDir); err != nil {
+		t.Fatalf("packer tests: error unpacking within limits: %v", err)
+	}
+
+	te.VerifyUnpack(t)
+
+	// Two megabytes of zeros compress far better than 10:1.
+	bomb := strings.Repeat("0", 2<<20)
+	writeTestPackage(t, te.PackagePath, [][2]string{{"zeros.csv", bomb}})
+
+	d = &datapackage.DataPackage{PackagePath: te.PackagePath, Limits: datapackage.UnpackLimits{MaxRatio: 10}}
+
+	err := d.Unpack(te.UnpackDataDir)
+
+	var limitErr *datapackage.LimitError
+	if !errors.As(err, &limitErr) || limitErr.Limit != "MaxRatio" {
+		t.Fatalf("packer tests: expected *LimitError for MaxRatio, got %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(te.UnpackDataDir, "zeros.csv")); !os.IsNotExist(err) {
+		t.Fatalf("packer tests: partial file not removed")
+	}
+	te.VerifyUnpack(t)
+
+	// A gzipped stream that looks like a ZIP package is copied to a temporary
+	// file within the limits, too.
+	f, err := os.Create(te.PackagePath)
+	if err != nil {
+		t.Fatalf("packer tests: can't create package: %v", err)
+	}
+	gw := gzip.NewWriter(f)
+	gw.Write([]byte("PK\x03\x04"))
+	gw.Write(make([]byte, 4<<20))
+	gw.Close()
+	f.Close()
+
+	temps, _ := filepath.Glob(filepath.Join(os.TempDir(), "datapackage-zip-*"))
+
+	for _, limits := range []datapackage.UnpackLimits{{MaxTotalSize: 1 << 20}, {MaxRatio: 10}} {
+		d = &datapackage.DataPackage{PackagePath: te.PackagePath, Limits: limits}
+
+		err = d.Unpack(te.UnpackDataDir)
+
+		limit := "MaxTotalSize"
+		if limits.MaxRatio != 0 {
+			limit = "MaxRatio"
+		}
+		if !errors.As(err, &limitErr) || limitErr.Limit != limit {
+			t.Fatalf("packer tests: expected *LimitError for %s copying zip package, got %v", limit, err)
+		}
+	}
+
+	if after, _ := filepath.Glob(filepath.Join(os.TempDir(), "datapackage-zip-*")); len(after) != len(temps) {
+		t.Fatalf("packer tests: temporary copy of zip package not removed")
+	}
+}
+
+func TestPackageWriter(t *testing.T) {
+	te := NewTestEnv(t, true)
+	defer te.RemoveTestFiles(t)
+
+	d := &datapackage.DataPackage{PackagePath: te.PackagePath, KeyPath: te.PublicKeyFilePath}
+
+	w, err := datapackage.NewPackageWriter(d)
+	if err != nil {
+		t.Fatalf("packer tests: error creating package writer: %v", err)
+	}
+
+	ew, err := w.Create("datafile1.csv", int64(len(testMsg)), time.Now())
+	if err != nil {
+		t.Fatalf("packer tests: error creating entry: %v", err)
+	}
+	if _, err = io.Copy(ew, strings.NewReader(testMsg)); err != nil {
+		t.Fatalf("packer tests: error writing entry: %v", err)
+	}
+
+	if err = w.AddFile(filepath.Join(te.DataDir, "datafile2.csv")); err != nil {
+		t.Fatalf("packer tests: error adding file: %v", err)
+	}
+
+	for _, name := range []string{"../evil.csv", "/evil.csv", datapackage.ManifestName} {
+		if _, err = w.Create(name, 0, time.Now()); err == nil {
+			t.Fatalf("packer tests: expected an error creating %s", name)
+		}
+	}
+
+	if _, err = w.Create("short.csv", 10, time.Now()); err != nil {
+		t.Fatalf("packer tests: error creating entry: %v", err)
+	}
+	if err = w.Close(); err == nil {
+		t.Fatalf("packer tests: expected an error closing after a short entry")
+	}
+
+	// The short entry spoiled the package, which is never created.
+	if _, err = os.Stat(te.PackagePath); !os.IsNotExist(err) {
+		t.Fatalf("packer tests: spoiled package created")
+	}
+
+	// Nor is it once Create has reported the short entry, although Close
+	// alone would not notice it in a ZIP package.
+	zipPath := filepath.Join(te.PackageDir, "short.zip")
+	if w, err = datapackage.NewPackageWriter(&datapackage.DataPackage{PackagePath: zipPath}); err != nil {
+		t.Fatalf("packer tests: error creating package writer: %v", err)
+	}
+	if ew, err = w.Create("a.csv", 10, time.Now()); err != nil {
+		t.Fatalf("packer tests: error creating entry: %v", err)
+	}
+	if _, err = ew.Write([]byte("short")); err != nil {
+		t.Fatalf("packer tests: error writing entry: %v", err)
+	}
+	if _, err = w.Create("b.csv", 0, time.Now()); err == nil {
+		t.Fatalf("packer tests: expected an error creating an entry after a short one")
+	}
+	if err = w.AddFile(filepath.Join(te.DataDir, "datafile2.csv")); err == nil {
+		t.Fatalf("packer tests: expected an error adding a file after a short entry")
+	}
+	if err = w.Close(); err == nil {
+		t.Fatalf("packer tests: expected an error closing after a short entry")
+	}
+	if _, err = os.Stat(zipPath); !os.IsNotExist(err) {
+		t.Fatalf("packer tests: spoiled package created")
+	}
+
+	if w, err = datapackage.NewPackageWriter(d); err != nil {
+		t.Fatalf("packer tests: error creating package writer: %v", err)
+	}
+	for _, name := range []string{"datafile1.csv", "datafile2.csv"} {
+		if ew, err = w.Create(name, int64(len(testMsg)), time.Now()); err != nil {
+			t.Fatalf("packer tests: error creating entry: %v", err)
+		}
+		if _, err = ew.Write([]byte(testMsg)); err != nil {
+			t.Fatalf("packer tests: error writing entry: %v", err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("packer tests: error closing package writer: %v", err)
+	}
+
+	d = &datapackage.DataPackage{PackagePath: te.PackagePath, KeyPath: te.PrivateKeyFilePath, KeyPassPath: te.PrivateKeyPassphrasePath}
+	if err = d.Unpack(te.UnpackDataDir); err != nil {
+		t.Fatalf("packer tests: error unpacking file: %v", err)
+	}
+
+	te.VerifyUnpack(t)
+}
+
+func TestAtomicPack(t *testing.T) {
+	te := NewTestEnv(t, false)
+	defer te.RemoveTestFiles(t)
+
+	// checkDir fails unless the package directory holds exactly the given
+	// files, so that no temporary file is left behind.
+	checkDir := func(names ...string) {
+		infos, err := ioutil.ReadDir(te.PackageDir)
+		if err != nil {
+			t.Fatalf("packer tests: error reading package directory: %v", err)
+		}
+		var got []string
+		for _, fi := range infos {
+			got = append(got, fi.Name())
+		}
+		if strings.Join(got, ",") != strings.Join(names, ",") {
+			t.Fatalf("packer tests: package directory holds %v, want %v", got, names)
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(te.DataDir, "notes.txt"), []byte("notes"), 0644); err != nil {
+		t.Fatalf("packer tests: error writing temp file: %v", err)
+	}
+
+	d := &datapackage.DataPackage{PackagePath: te.PackagePath}
+	if err := d.Pack(te.DataDir); err == nil {
+		t.Fatalf("packer tests: expected an error packing an unmatched file")
+	}
+	checkDir()
+
+	d.OnUnmatched = datapackage.UnmatchedSkip
+	if err := d.Pack(te.DataDir); err != nil {
+		t.Fatalf("packer tests: error packing file: %v", err)
+	}
+	checkDir(filepath.Base(te.PackagePath))
+
+	fi, err := os.Stat(te.PackagePath)
+	if err != nil {
+		t.Fatalf("packer tests: error reading package: %v", err)
+	}
+	if fi.Mode().Perm() != 0644 {
+		t.Fatalf("packer tests: package has mode %v, want 0644", fi.Mode().Perm())
+	}
+
+	// An existing package is never replaced.
+	if err = d.Pack(te.DataDir); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("packer tests: expected fs.ErrExist packing onto a package, got %v", err)
+	}
+	checkDir(filepath.Base(te.PackagePath))
+
+	// Nor is one that appears while the package is being written.
+	otherPath := filepath.Join(te.PackageDir, "other.tar.gz")
+
+	w, err := datapackage.NewPackageWriter(&datapackage.DataPackage{PackagePath: otherPath})
+	if err != nil {
+		t.Fatalf("packer tests: error creating package writer: %v", err)
+	}
+	if err = w.AddFile(filepath.Join(te.DataDir, "datafile1.csv")); err != nil {
+		t.Fatalf("packer tests: error adding file: %v", err)
+	}
+	if err = ioutil.WriteFile(otherPath, []byte("other"), 0644); err != nil {
+		t.Fatalf("packer tests: error writing temp file: %v", err)
+	}
+	if err = w.Close(); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("packer tests: expected fs.ErrExist closing onto a new file, got %v", err)
+	}
+	if content, _ := ioutil.ReadFile(otherPath); string(content) != "other" {
+		t.Fatalf("packer tests: file created while packing was replaced")
+	}
+	os.Remove(otherPath)
+	checkDir(filepath.Base(te.PackagePath))
+
+	if err = d.Unpack(te.UnpackDataDir); err != nil {
+		t.Fatalf("packer tests: error unpacking file: %v", err)
+	}
+
+	te.VerifyUnpack(t)
+}
+
+func TestPackageReader(t *testing.T) {
+	te := NewTestEnv(t, true)
+	defer te.RemoveTestFiles(t)
+
+	d := &datapackage.DataPackage{PackagePath: te.PackagePath, KeyPath: te.PublicKeyFilePath}
+	if err := d.Pack(te.DataDir); err != nil {
+		t.Fatalf("packer tests: error packing file: %v", err)
+	}
+
+	d = &datapackage.DataPackage{PackagePath: te.PackagePath, KeyPath: te.PrivateKeyFilePath, KeyPassPath: te.PrivateKeyPassphrasePath}
+
+	r, err := datapackage.NewPackageReader(d)
+	if err != nil {
+		t.Fatalf("packer tests: error creating package reader: %v", err)
+	}
+	defer r.Close()
+
+	var names []string
+
+	for {
+		entry, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("packer tests: error reading package: %v", err)
+		}
+
+		names = append(names, entry.Name)
+
+		if entry.Size != int64(len(testMsg)) || !entry.Mode.IsRegular() || entry.ModTime.IsZero() {
+			t.Fatalf("packer tests: unexpected entry: %+v", entry)
+		}
+
+		// Leave the second file unread, which Next skips.
+		if entry.Name == "datafile2.csv" {
+			continue
+		}
+
+		content, err := ioutil.ReadAll(r)
+		if err != nil || string(content) != testMsg {
+			t.Fatalf("packer tests: %s not successfully read: %v", entry.Name, err)
+		}
+	}
+
+	if strings.Join(names, ",") != "datafile1.csv,datafile2.csv" {
+		t.Fatalf("packer tests: unexpected entries %v", names)
+	}
+	if m := r.Manifest(); m == nil || len(m.Files) != 2 {
+		t.Fatalf("packer tests: unexpected manifest %+v", m)
+	}
+
+	// A file that does not match the manifest is reported at the end.
+	manifest, _ := json.Marshal(&datapackage.Manifest{
+		Files: []datapackage.ManifestFile{
+			{Path: "datafile1.csv", Size: int64(len(testMsg)), SHA256: "0000"},
+		},
+	})
+
+	writeTestPackage(t, te.PackagePath, [][2]string{
+		{"datafile1.csv", testMsg},
+		{datapackage.ManifestName, string(manifest)},
+	})
+
+	if r, err = datapackage.NewPackageReader(&datapackage.DataPackage{PackagePath: te.PackagePath}); err != nil {
+		t.Fatalf("packer tests: error creating package reader: %v", err)
+	}
+	defer r.Close()
+
+	if _, err = r.Next(); err != nil {
+		t.Fatalf("packer tests: error reading package: %v", err)
+	}
+
+	var manifestErr *datapackage.ManifestError
+	if _, err = r.Next(); !errors.As(err, &manifestErr) {
+		t.Fatalf("packer tests: expected *ManifestError, got %v", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	te := NewTestEnv(t, false)
+	defer te.RemoveTestFiles(t)
+
+	d := &datapackage.DataPackage{PackagePath: te.PackagePath}
+	if err := d.Pack(te.DataDir); err != nil {
+		t.Fatalf("packer tests: error packing file: %v", err)
+	}
+
+	entries, err := d.List()
+	if err != nil {
+		t.Fatalf("packer tests: error listing package: %v", err)
+	}
+
+	sum := sha256.Sum256([]byte(testMsg))
+
+	if len(entries) != 2 {
+		t.Fatalf("packer tests: listed %d entries, expected 2", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.Path != "datafile"+strconv.Itoa(i+1)+".csv" || entry.Size != int64(len(testMsg)) || entry.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Fatalf("packer tests: unexpected entry %+v", entry)
+		}
+	}
+
+	if fis, _ := ioutil.ReadDir(te.UnpackDataDir); len(fis) != 0 {
+		t.Fatalf("packer tests: List extracted files")
+	}
+}
+
+func TestOpenFS(t *testing.T) {
+	te := NewTestEnv(t, false)
+	defer te.RemoveTestFiles(t)
+
+	if err := os.Mkdir(filepath.Join(te.DataDir, "sub"), 0755); err != nil {
+		t.Fatalf("packer tests: can't create directory: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(te.DataDir, "sub", "datafile3.csv"), []byte(testMsg), 0644); err != nil {
+		t.Fatalf("packer tests: error writing temp file: %v", err)
+	}
+
+	d := &datapackage.DataPackage{PackagePath: te.PackagePath}
+	if err := d.Pack(te.DataDir); err != nil {
+		t.Fatalf("packer tests: error packing file: %v", err)
+	}
+
+	fsys, err := datapackage.OpenFS(&datapackage.DataPackage{PackagePath: te.PackagePath})
+	if err != nil {
+		t.Fatalf("packer tests: error opening package FS: %v", err)
+	}
+	defer fsys.Close()
+
+	if err = fstest.TestFS(fsys, "datafile1.csv", "datafile2.csv", "sub/datafile3.csv"); err != nil {
+		t.Fatalf("packer tests: %v", err)
+	}
+
+	content, err := fs.ReadFile(fsys, "sub/datafile3.csv")
+	if err != nil || string(content) != testMsg {
+		t.Fatalf("packer tests: sub/datafile3.csv not successfully read: %v", err)
+	}
+
+	if _, err = fs.Stat(fsys, datapackage.ManifestName); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("packer tests: expected the manifest to be left out, got %v", err)
+	}
+}
+
+func TestInclusionRules(t *testing.T) {
+	te := NewTestEnv(t, false)
+	defer te.RemoveTestFiles(t)
+
+	files := map[string]string{
+		"README.md":                "readme",
+		"person.csv.gz":            "gzipped",
+		"scratch/notes.csv":        testMsg,
+		"extra/datafile3.csv":      testMsg,
+		datapackage.PackIgnoreName: "# scratch work\nscratch/\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(te.DataDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("packer tests: can't create directory: %v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("packer tests: error writing temp file: %v", err)
+		}
+	}
+
+	cases := []struct {
+		d        datapackage.DataPackage
+		expected string // Packed paths, or "error".
+	}{
+		{datapackage.DataPackage{}, "error"},
+		{datapackage.DataPackage{OnUnmatched: datapackage.UnmatchedSkip}, "datafile1.csv,datafile2.csv,extra/datafile3.csv"},
+		{datapackage.DataPackage{OnUnmatched: datapackage.UnmatchedInclude}, "README.md,datafile1.csv,datafile2.csv,extra/datafile3.csv,person.csv.gz"},
+		{datapackage.DataPackage{Extensions: []string{".csv", ".CSV.GZ"}, Exclude: []string{"README.md", "extra/"}}, "datafile1.csv,datafile2.csv,person.csv.gz"},
+		{datapackage.DataPackage{Include: []string{"datafile*.csv", "extra/*"}, OnUnmatched: datapackage.UnmatchedSkip}, "datafile1.csv,datafile2.csv,extra/datafile3.csv"},
+		{datapackage.DataPackage{Include: []string{"[bad"}}, "error"},
+	}
+
+	for i, c := range cases {
+		os.Remove(te.PackagePath)
+
+		d := c.d
+		d.PackagePath = te.PackagePath
+
+		if err := d.Pack(te.DataDir); err != nil {
+			if c.expected != "error" {
+				t.Fatalf("packer tests: case %d: error packing file: %v", i, err)
+			}
+			continue
+		}
+		if c.expected == "error" {
+			t.Fatalf("packer tests: case %d: expected an error packing file", i)
+		}
+
+		entries, err := d.List()
+		if err != nil {
+			t.Fatalf("packer tests: case %d: error listing package: %v", i, err)
+		}
+
+		var paths []string
+		for _, entry := range entries {
+			paths = append(paths, entry.Path)
+		}
+		sort.Strings(paths)
+
+		if got := strings.Join(paths, ","); got != c.expected {
+			t.Fatalf("packer tests: case %d: packed %s, expected %s", i, got, c.expected)
+		}
+	}
+}
+
+// countdownContext is a context that is cancelled once Err has been called n
+// times, so that tests can cancel at a given point.
+type countdownContext struct {
+	context.Context
+	n int
+}
+
+func (c *countdownContext) Err() error {
+	if c.n--; c.n < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestContext(t *testing.T) {
+	te := NewTestEnv(t, false)
+	defer te.RemoveTestFiles(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	d := &datapackage.DataPackage{PackagePath: te.PackagePath}
+	if err := d.PackContext(ctx, te.DataDir); !errors.Is(err, context.Canceled) {
+		t.Fatalf("packer tests: expected context.Canceled, got %v", err)
+	}
+
+	// Cancel while copying the second file.
+	if err := d.PackContext(&countdownContext{Context: context.Background(), n: 4}, te.DataDir); !errors.Is(err, context.Canceled) {
+		t.Fatalf("packer tests: expected context.Canceled, got %v", err)
+	}
+	if _, err := os.Stat(te.PackagePath); !os.IsNotExist(err) {
+		t.Fatalf("packer tests: partial package not removed")
+	}
+
+	// A partial package written to STDOUT cannot be removed, but must not
+	// pass for a complete one. It is cancelled once a large first file, some
+	// of which is sure to reach STDOUT, has been written.
+	big := make([]byte, 1<<20)
+	rand.Read(big)
+	if err := ioutil.WriteFile(filepath.Join(te.DataDir, "big.csv"), big, 0644); err != nil {
+		t.Fatalf("packer tests: error writing temp file: %v", err)
+	}
+
+	partialPath := filepath.Join(te.PackageDir, "partial.tar.gz")
+	partial, err := os.Create(partialPath)
+	if err != nil {
+		t.Fatalf("packer tests: error creating file: %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	stdout := os.Stdout
+	os.Stdout = partial
+	err = (&datapackage.DataPackage{Progress: func(e datapackage.ProgressEvent) {
+		if e.FileBytes == int64(len(big)) {
+			cancel()
+		}
+	}}).PackContext(ctx, te.DataDir)
+	os.Stdout = stdout
+	partial.Close()
+
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("packer tests: expected context.Canceled, got %v", err)
+	}
+	if err = (&datapackage.DataPackage{PackagePath: partialPath}).Unpack(filepath.Join(te.UnpackDataDir, "partial")); err == nil {
+		t.Fatalf("packer tests: partial package on STDOUT unpacked without error")
+	}
+	os.Remove(filepath.Join(te.DataDir, "big.csv"))
+
+	if err := d.PackContext(context.Background(), te.DataDir); err != nil {
+		t.Fatalf("packer tests: error packing file: %v", err)
+	}
+
+	unpackDir := filepath.Join(te.UnpackDataDir, "out")
+
+	// Cancel while copying the second file.
+	if err := d.UnpackContext(&countdownContext{Context: context.Background(), n: 5}, unpackDir); !errors.Is(err, context.Canceled) {
+		t.Fatalf("packer tests: expected context.Canceled, got %v", err)
+	}
+	if _, err := os.Stat(unpackDir); !os.IsNotExist(err) {
+		t.Fatalf("packer tests: partial unpack not removed")
+	}
+
+	if err := d.UnpackContext(context.Background(), te.UnpackDataDir); err != nil {
+		t.Fatalf("packer tests: error unpacking file: %v", err)
+	}
+
+	te.VerifyUnpack(t)
+}
+
+func TestProgress(t *testing.T) {
+	te := NewTestEnv(t, false)
+	defer te.RemoveTestFiles(t)
+
+	var events []datapackage.ProgressEvent
+	record := func(e datapackage.ProgressEvent) { events = append(events, e) }
+
+	size := int64(2 * len(testMsg))
+
+	check := func(op string, total int64) {
+		if len(events) == 0 {
+			t.Fatalf("packer tests: no %s progress reported", op)
+		}
+		files := make(map[string]bool)
+		for _, e := range events {
+			if e.Op != op || e.TotalBytes != total || e.FileBytes > e.FileSize || e.Bytes > size {
+				t.Fatalf("packer tests: unexpected %s progress event: %+v", op, e)
+			}
+			files[e.Path] = true
+		}
+		if last := events[len(events)-1]; last.Bytes != size || len(files) != 2 {
+			t.Fatalf("packer tests: %s progress ended at %+v for %d files", op, last, len(files))
+		}
+		events = nil
+	}
+
+	d := &datapackage.DataPackage{PackagePath: te.PackagePath, Progress: record}
+	if err := d.Pack(te.DataDir); err != nil {
+		t.Fatalf("packer tests: error packing file: %v", err)
+	}
+	check("pack", size)
+
+	// Tar packages give no total up front, only the size of each file.
+	if err := d.Unpack(te.UnpackDataDir); err != nil {
+		t.Fatalf("packer tests: error unpacking file: %v", err)
+	}
+	for _, e := range events {
+		if e.FileSize != int64(len(testMsg)) {
+			t.Fatalf("packer tests: unpack progress event without file size: %+v", e)
+		}
+	}
+	check("unpack", -1)
+
+	os.RemoveAll(te.UnpackDataDir)
+
+	d.PackagePath = filepath.Join(te.PackageDir, "test.zip")
+	if err := d.Pack(te.DataDir); err != nil {
+		t.Fatalf("packer tests: error packing zip file: %v", err)
+	}
+	events = nil
+
+	if err := d.Unpack(te.UnpackDataDir); err != nil {
+		t.Fatalf("packer tests: error unpacking zip file: %v", err)
+	}
+	check("unpack", size)
+}
+
+func TestLogger(t *testing.T) {
+	te := NewTestEnv(t, false)
+	defer te.RemoveTestFiles(t)
+
+	if err := ioutil.WriteFile(filepath.Join(te.DataDir, "notes.txt"), []byte("notes"), 0644); err != nil {
+		t.Fatalf("packer tests: error writing temp file: %v", err)
+	}
+
+	var buf bytes.Buffer
+
+	d := &datapackage.DataPackage{
+		PackagePath: te.PackagePath,
+		OnUnmatched: datapackage.UnmatchedSkip,
+		Logger:      slog.New(slog.NewJSONHandler(&buf, nil)),
+	}
+	if err := d.Pack(te.DataDir); err != nil {
+		t.Fatalf("packer tests: error packing file: %v", err)
+	}
+	if err := d.Unpack(te.UnpackDataDir); err != nil {
+		t.Fatalf("packer tests: error unpacking file: %v", err)
+	}
+
+	type record struct {
+		Level string
+		Msg   string
+		File  string
+		Size  int64
+		Phase string
+	}
+
+	var got []record
+
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var r record
+		if err := dec.Decode(&r); err != nil {
+			t.Fatalf("packer tests: error decoding log record: %v", err)
+		}
+		got = append(got, r)
+	}
+
+	size := int64(len(testMsg))
+	want := []record{
+		{"WARN", "skipping unmatched file", "notes.txt", 5, "scan"},
+		{"INFO", "packing file", "datafile1.csv", size, "pack"},
+		{"INFO", "packing file", "datafile2.csv", size, "pack"},
+		{"INFO", "unpacking file", "datafile1.csv", size, "unpack"},
+		{"INFO", "unpacking file", "datafile2.csv", size, "unpack"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("packer tests: logged %+v, want %+v", got, want)
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	te := NewTestEnv(t, false)
+	defer te.RemoveTestFiles(t)
+
+	d := &datapackage.DataPackage{PackagePath: te.PackagePath}
+	if err := d.Pack(te.DataDir); err != nil {
+		t.Fatalf("packer tests: error packing file: %v", err)
+	}
+
+	file1 := filepath.Join(te.UnpackDataDir, "datafile1.csv")
+	file2 := filepath.Join(te.UnpackDataDir, "datafile2.csv")
+
+	// reset leaves only datafile2.csv in the target directory, holding "old"
+	// and modified at modTime.
+	reset := func(modTime time.Time) {
+		os.Remove(file1)
+		os.Remove(filepath.Join(te.UnpackDataDir, "datafile2.1.csv"))
+		if err := ioutil.WriteFile(file2, []byte("old"), 0644); err != nil {
+			t.Fatalf("packer tests: error writing temp file: %v", err)
+		}
+		if err := os.Chtimes(file2, modTime, modTime); err != nil {
+			t.Fatalf("packer tests: error setting modification time: %v", err)
+		}
+	}
+
+	content := func(path string) string {
+		b, _ := ioutil.ReadFile(path)
+		return string(b)
+	}
+
+	// By default nothing is extracted: every entry is checked before any is
+	// moved out of the staging directory, so datafile1.csv, which does not
+	// conflict, is not extracted either.
+	reset(time.Now())
+	var conflictErr *datapackage.ConflictError
+	if err := d.Unpack(te.UnpackDataDir); !errors.As(err, &conflictErr) || len(conflictErr.Names) != 1 || conflictErr.Names[0] != "datafile2.csv" {
+		t.Fatalf("packer tests: expected a conflict on datafile2.csv, got %v", err)
+	}
+	if _, err := os.Stat(file1); !os.IsNotExist(err) || content(file2) != "old" {
+		t.Fatalf("packer tests: files extracted despite a conflict")
+	}
+
+	tests := []struct {
+		policy  datapackage.ConflictPolicy
+		modTime time.Time
+		check   func(r *datapackage.UnpackReport) bool
+	}{
+		{datapackage.ConflictSkip, time.Now(), func(r *datapackage.UnpackReport) bool {
+			return len(r.Skipped) == 1 && content(file2) == "old"
+		}},
+		{datapackage.ConflictOverwrite, time.Now().Add(time.Hour), func(r *datapackage.UnpackReport) bool {
+			return len(r.Overwritten) == 1 && content(file2) == testMsg
+		}},
+		{datapackage.ConflictNewer, time.Now().Add(time.Hour), func(r *datapackage.UnpackReport) bool {
+			return len(r.Skipped) == 1 && content(file2) == "old"
+		}},
+		{datapackage.ConflictNewer, time.Now().Add(-time.Hour), func(r *datapackage.UnpackReport) bool {
+			return len(r.Overwritten) == 1 && content(file2) == testMsg
+		}},
+		{datapackage.ConflictRename, time.Now(), func(r *datapackage.UnpackReport) bool {
+			return r.Renamed["datafile2.csv"] == "datafile2.1.csv" && content(file2) == "old" &&
+				content(filepath.Join(te.UnpackDataDir, "datafile2.1.csv")) == testMsg
+		}},
+	}
+
+	for _, test := range tests {
+		reset(test.modTime)
+
+		d.OnConflict = test.policy
+		if err := d.Unpack(te.UnpackDataDir); err != nil {
+			t.Fatalf("packer tests: error unpacking with %s policy: %v", test.policy, err)
+		}
+
+		r := d.Unpacked
+		if len(r.Created) != 1 || r.Created[0] != "datafile1.csv" || content(file1) != testMsg || !test.check(r) {
+			t.Fatalf("packer tests: unexpected outcome for %s policy: %+v", test.policy, r)
+		}
+	}
+}
+
+func TestStagedUnpack(t *testing.T) {
+	te := NewTestEnv(t, false)
+	defer te.RemoveTestFiles(t)
+
+	d := &datapackage.DataPackage{PackagePath: te.PackagePath, OnConflict: datapackage.ConflictOverwrite}
+	if err := d.Pack(te.DataDir); err != nil {
+		t.Fatalf("packer tests: error packing file: %v", err)
+	}
+
+	// checkStaging fails if a staging directory was left in or next to dir.
+	checkStaging := func(dir string) {
+		matches, _ := filepath.Glob(filepath.Join(filepath.Dir(dir), "."+filepath.Base(dir)+".unpack-*"))
+		inside, _ := filepath.Glob(filepath.Join(dir, ".unpack-*"))
+		if matches = append(matches, inside...); len(matches) > 0 {
+			t.Fatalf("packer tests: staging directory left behind: %v", matches)
+		}
+	}
+
+	// Cut the package short, so that it fails at the end.
+	b, err := ioutil.ReadFile(te.PackagePath)
+	if err != nil {
+		t.Fatalf("packer tests: error reading package: %v", err)
+	}
+	badPath := filepath.Join(te.PackageDir, "bad.tar.gz")
+	if err = ioutil.WriteFile(badPath, b[:len(b)-20], 0644); err != nil {
+		t.Fatalf("packer tests: error writing package: %v", err)
+	}
+
+	file1 := filepath.Join(te.UnpackDataDir, "datafile1.csv")
+	if err = ioutil.WriteFile(file1, []byte("old"), 0644); err != nil {
+		t.Fatalf("packer tests: error writing temp file: %v", err)
+	}
+
+	bad := &datapackage.DataPackage{PackagePath: badPath, OnConflict: datapackage.ConflictOverwrite}
+	if err = bad.Unpack(te.UnpackDataDir); err == nil {
+		t.Fatalf("packer tests: expected an error unpacking a truncated package")
+	}
+	if content, _ := ioutil.ReadFile(file1); string(content) != "old" {
+		t.Fatalf("packer tests: existing file changed by failed unpack")
+	}
+	if _, err = os.Stat(filepath.Join(te.UnpackDataDir, "datafile2.csv")); !os.IsNotExist(err) {
+		t.Fatalf("packer tests: file left behind by failed unpack")
+	}
+	checkStaging(te.UnpackDataDir)
+
+	newDir := filepath.Join(te.UnpackDataDir, "new", "dir")
+	if err = bad.Unpack(newDir); err == nil {
+		t.Fatalf("packer tests: expected an error unpacking a truncated package")
+	}
+	if _, err = os.Stat(filepath.Join(te.UnpackDataDir, "new")); !os.IsNotExist(err) {
+		t.Fatalf("packer tests: directory left behind by failed unpack")
+	}
+
+	// Into an existing directory, replacing a file, and into a new one.
+	if err = d.Unpack(te.UnpackDataDir); err != nil {
+		t.Fatalf("packer tests: error unpacking file: %v", err)
+	}
+	te.VerifyUnpack(t)
+	checkStaging(te.UnpackDataDir)
+
+	if err = d.Unpack(newDir); err != nil {
+		t.Fatalf("packer tests: error unpacking file: %v", err)
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(newDir, "datafile2.csv")); string(content) != testMsg {
+		t.Fatalf("packer tests: datafile2.csv not successfully unpacked")
+	}
+	checkStaging(newDir)
+
+	// Into the working directory, staging next to it, where no partial file
+	// shows in it, unless its parent is not writable.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("packer tests: error getting working directory: %v", err)
+	}
+	defer os.Chdir(wd)
+
+	existing := filepath.Join(te.UnpackDataDir, "existing")
+	if err = os.Mkdir(existing, 0755); err != nil {
+		t.Fatalf("packer tests: can't create directory: %v", err)
+	}
+	if err = os.Chdir(existing); err != nil {
+		t.Fatalf("packer tests: error changing directory: %v", err)
+	}
+
+	var staged []string
+	stagedIn := func(pattern string) func(datapackage.ProgressEvent) {
+		staged = nil
+		return func(datapackage.ProgressEvent) {
+			if staged == nil {
+				staged, _ = filepath.Glob(pattern)
+			}
+		}
+	}
+
+	d.Progress = stagedIn(filepath.Join(te.UnpackDataDir, ".existing.unpack-*"))
+	if err = d.Unpack(""); err != nil {
+		t.Fatalf("packer tests: error unpacking file: %v", err)
+	}
+	if len(staged) != 1 {
+		t.Fatalf("packer tests: staged in %v, want a directory next to %s", staged, existing)
+	}
+	checkStaging(existing)
+
+	// Only an unprivileged user is kept out of a read-only parent.
+	if os.Geteuid() != 0 {
+		if err = os.Chmod(te.UnpackDataDir, 0555); err != nil {
+			t.Fatalf("packer tests: error changing mode: %v", err)
+		}
+		defer os.Chmod(te.UnpackDataDir, 0755)
+
+		d.Progress = stagedIn(filepath.Join(existing, ".unpack-*"))
+		if err = d.Unpack(""); err != nil {
+			t.Fatalf("packer tests: error unpacking file: %v", err)
+		}
+		if len(staged) != 1 {
+			t.Fatalf("packer tests: staged in %v, want a directory inside %s", staged, existing)
+		}
+		checkStaging(existing)
+	}
+
+	if content, _ := ioutil.ReadFile(filepath.Join(existing, "datafile2.csv")); string(content) != testMsg {
+		t.Fatalf("packer tests: datafile2.csv not successfully unpacked")
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	te := NewTestEnv(t, false)
+	defer te.RemoveTestFiles(t)
+
+	modTime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	dirTime := time.Date(2002, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	pkgPath := filepath.Join(te.PackageDir, "meta.tar.gz")
+	writeTestEntries(t, pkgPath, []*tar.Header{
+		{Name: "sub/", Typeflag: tar.TypeDir, Mode: 0700, ModTime: dirTime},
+		{Name: "sub/private.csv", Typeflag: tar.TypeReg, Mode: 0600, Size: int64(len(testMsg)), ModTime: modTime},
+		{Name: "open.csv", Typeflag: tar.TypeReg, Mode: 0666, Size: int64(len(testMsg)), ModTime: modTime},
+	}, []string{"", testMsg, testMsg})
+
+	// check fails unless the file at path has the given permissions and,
+	// unless it is zero, modification time.
+	check := func(path string, mode os.FileMode, mtime time.Time) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("packer tests: error reading unpacked file: %v", err)
+		}
+		if fi.Mode().Perm() != mode {
+			t.Fatalf("packer tests: %s has mode %v, want %v", path, fi.Mode().Perm(), mode)
+		}
+		if !mtime.IsZero() && !fi.ModTime().Equal(mtime) {
+			t.Fatalf("packer tests: %s modified at %v, want %v", path, fi.ModTime(), mtime)
+		}
+	}
+
+	// The modes in the package apply regardless of the umask.
+	d := &datapackage.DataPackage{PackagePath: pkgPath, RestoreModTime: true}
+	if err := d.Unpack(te.UnpackDataDir); err != nil {
+		t.Fatalf("packer tests: error unpacking file: %v", err)
+	}
+
+	check(filepath.Join(te.UnpackDataDir, "sub"), 0700, dirTime)
+	check(filepath.Join(te.UnpackDataDir, "sub", "private.csv"), 0600, modTime)
+	check(filepath.Join(te.UnpackDataDir, "open.csv"), 0666, modTime)
+
+	// An explicit policy applies to everything, including the new target
+	// directory.
+	target := filepath.Join(te.UnpackDataDir, "phi")
+	d = &datapackage.DataPackage{PackagePath: pkgPath, FileMode: 0640, DirMode: 0750}
+	if err := d.Unpack(target); err != nil {
+		t.Fatalf("packer tests: error unpacking file: %v", err)
+	}
+
+	check(target, 0750, time.Time{})
+	check(filepath.Join(target, "sub"), 0750, time.Time{})
+	check(filepath.Join(target, "sub", "private.csv"), 0640, time.Time{})
+	check(filepath.Join(target, "open.csv"), 0640, time.Time{})
+
+	if fi, _ := os.Stat(filepath.Join(target, "open.csv")); fi.ModTime().Equal(modTime) {
+		t.Fatalf("packer tests: modification time restored without RestoreModTime")
+	}
+
+	// Read-only directories are filled before they are made read-only, into
+	// a new target directory and an existing one alike.
+	roPath := filepath.Join(te.PackageDir, "readonly.tar.gz")
+	writeTestEntries(t, roPath, []*tar.Header{
+		{Name: "sub/", Typeflag: tar.TypeDir, Mode: 0555, ModTime: dirTime},
+		{Name: "sub/a.csv", Typeflag: tar.TypeReg, Mode: 0444, Size: int64(len(testMsg)), ModTime: modTime},
+		{Name: "deep/er/b.csv", Typeflag: tar.TypeReg, Mode: 0444, Size: int64(len(testMsg)), ModTime: modTime},
+	}, []string{"", testMsg, testMsg})
+
+	existing := filepath.Join(te.UnpackDataDir, "existing")
+	if err := os.Mkdir(existing, 0755); err != nil {
+		t.Fatalf("packer tests: can't create directory: %v", err)
+	}
+
+	for _, target := range []string{filepath.Join(te.UnpackDataDir, "ro"), existing} {
+		d = &datapackage.DataPackage{PackagePath: roPath, RestoreModTime: true}
+		if err := d.Unpack(target); err != nil {
+			t.Fatalf("packer tests: error unpacking read-only directory: %v", err)
+		}
+		check(filepath.Join(target, "sub"), 0555, dirTime)
+		check(filepath.Join(target, "sub", "a.csv"), 0444, modTime)
+
+		d = &datapackage.DataPackage{PackagePath: roPath, DirMode: 0550, OnConflict: datapackage.ConflictOverwrite}
+		target = filepath.Join(target, "policy")
+		if err := d.Unpack(target); err != nil {
+			t.Fatalf("packer tests: error unpacking with a read-only DirMode: %v", err)
+		}
+		check(target, 0550, time.Time{})
+		check(filepath.Join(target, "sub"), 0550, time.Time{})
+		check(filepath.Join(target, "deep", "er"), 0550, time.Time{})
+		check(filepath.Join(target, "deep", "er", "b.csv"), 0444, time.Time{})
+	}
+
+	// Make everything writable again to clean up.
+	filepath.Walk(te.UnpackDataDir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.IsDir() {
+			os.Chmod(path, 0755)
+		}
+		return nil
+	})
+}
+
+func TestReproducible(t *testing.T) {
+	te := NewTestEnv(t, false)
+	defer te.RemoveTestFiles(t)
+
+	// A second copy of the data, written in the other order, with other
+	// permissions and modification times.
+	otherDir, err := ioutil.TempDir("", "testdatadir")
+	if err != nil {
+		t.Fatalf("packer tests: can't create temporary directory")
+	}
+	defer os.RemoveAll(otherDir)
+
+	for _, name := range []string{"datafile2.csv", "datafile1.csv"} {
+		path := filepath.Join(otherDir, name)
+		if err = ioutil.WriteFile(path, []byte(testMsg), 0600); err != nil {
+			t.Fatalf("packer tests: error writing temp file: %v", err)
+		}
+		old := time.Now().Add(-time.Hour)
+		if err = os.Chtimes(path, old, old); err != nil {
+			t.Fatalf("packer tests: error setting modification time: %v", err)
+		}
+	}
+
+	pack := func(dir string, name string) []byte {
+		path := filepath.Join(te.PackageDir, name)
+		d := &datapackage.DataPackage{PackagePath: path, Reproducible: true}
+		if err := d.Pack(dir); err != nil {
+			t.Fatalf("packer tests: error packing file: %v", err)
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("packer tests: error reading package: %v", err)
+		}
+		return b
+	}
+
+	first := pack(te.DataDir, "first.tar.gz")
+	if !bytes.Equal(first, pack(otherDir, "second.tar.gz")) {
+		t.Fatalf("packer tests: reproducible packages differ")
+	}
+
+	// Modification times are clamped to SOURCE_DATE_EPOCH.
+	epoch := time.Date(2001, 9, 9, 1, 46, 40, 0, time.UTC)
+	old := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err = os.Chtimes(filepath.Join(otherDir, "datafile1.csv"), old, old); err != nil {
+		t.Fatalf("packer tests: error setting modification time: %v", err)
+	}
+
+	t.Setenv(datapackage.SourceDateEpochEnv, strconv.FormatInt(epoch.Unix(), 10))
+	pack(otherDir, "epoch.tar.gz")
+
+	d := &datapackage.DataPackage{PackagePath: filepath.Join(te.PackageDir, "epoch.tar.gz")}
+	entries, err := d.List()
+	if err != nil {
+		t.Fatalf("packer tests: error listing package: %v", err)
+	}
+	if len(entries) != 2 || !entries[0].ModTime.Equal(old) || !entries[1].ModTime.Equal(epoch) {
+		t.Fatalf("packer tests: unexpected modification times: %+v", entries)
+	}
+}
+
+func TestDescriptor(t *testing.T) {
+	te := NewTestEnv(t, false)
+	defer te.RemoveTestFiles(t)
+
+	if err := ioutil.WriteFile(filepath.Join(te.DataDir, "person.csv"), []byte("person_id,year_of_birth\r\n1,1970\r\n"), 0666); err != nil {
+		t.Fatalf("packer tests: error writing temp file: %v", err)
+	}
+
+	d := &datapackage.DataPackage{PackagePath: te.PackagePath, WriteDescriptor: true}
+
+	if err := d.Pack(te.DataDir); err != nil {
+		t.Fatalf("packer tests: error packing file: %v", err)
+	}
+
+	desc, err := d.ReadDescriptor()
+	if err != nil {
+		t.Fatalf("packer tests: error reading descriptor: %v", err)
+	}
+
+	if len(desc.Resources) != 3 {
+		t.Fatalf("packer tests: descriptor has %d resources, expected 3", len(desc.Resources))
+	}
+
+	person := desc.Resources[2]
+	if person.Name != "person" || person.Path != "person.csv" || person.Dialect.LineTerminator != "\r\n" {
+		t.Fatalf("packer tests: unexpected person resource: %+v", person)
+	}
+	if len(person.Schema.Fields) != 2 || person.Schema.Fields[1].Name != "year_of_birth" {
+		t.Fatalf("packer tests: unexpected person schema: %+v", person.Schema)
+	}
+
+	if err = d.Unpack(te.UnpackDataDir); err != nil {
+		t.Fatalf("packer tests: error unpacking file: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(te.UnpackDataDir, datapackage.DescriptorName)); err != nil {
+		t.Fatalf("packer tests: descriptor not extracted: %v", err)
+	}
+
+	d = &datapackage.DataPackage{PackagePath: te.PackagePath + ".none"}
+	if err = d.Pack(te.DataDir); err != nil {
+		t.Fatalf("packer tests: error packing file: %v", err)
+	}
+	if _, err = d.ReadDescriptor(); err != datapackage.ErrNoDescriptor {
+		t.Fatalf("packer tests: expected ErrNoDescriptor, got %v", err)
+	}
+
+	// Paths that map to the same resource name still get unique names.
+	d = &datapackage.DataPackage{PackagePath: filepath.Join(te.PackageDir, "names.tar.gz"), WriteDescriptor: true}
+	w, err := datapackage.NewPackageWriter(d)
+	if err != nil {
+		t.Fatalf("packer tests: error creating package writer: %v", err)
+	}
+	for _, name := range []string{"a/b.csv", "a-b.csv", "A-B.csv", "a-b-2.csv"} {
+		if _, err = w.Create(name, 0, time.Now()); err != nil {
+			t.Fatalf("packer tests: error creating entry: %v", err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("packer tests: error closing package writer: %v", err)
+	}
+
+	if desc, err = d.ReadDescriptor(); err != nil {
+		t.Fatalf("packer tests: error reading descriptor: %v", err)
+	}
+	var names []string
+	for _, r := range desc.Resources {
+		names = append(names, r.Name)
+	}
+	if got := strings.Join(names, ","); got != "a-b,a-b-2,a-b-3,a-b-2-2" {
+		t.Fatalf("packer tests: resource names %s, want unique ones", got)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	for _, c := range []datapackage.Compression{datapackage.CompressionZstd, datapackage.CompressionXZ, datapackage.CompressionNone} {
+		te := NewTestEnv(t, false)
+
+		d := &datapackage.DataPackage{PackagePath: te.PackagePath, Compression: c}
+		if err := d.Pack(te.DataDir); err != nil {
+			t.Fatalf("packer tests: %s: error packing file: %v", c, err)
+		}
+
+		// Unpack detects the codec, whatever the package extension says.
+		d = &datapackage.DataPackage{PackagePath: te.PackagePath}
+		if err := d.Unpack(te.UnpackDataDir); err != nil {
+			t.Fatalf("packer tests: %s: error unpacking file: %v", c, err)
+		}
+
+		te.VerifyUnpack(t)
+		te.RemoveTestFiles(t)
+	}
+
+	te := NewTestEnv(t, false)
+	defer te.RemoveTestFiles(t)
+
+	d := &datapackage.DataPackage{PackagePath: te.PackagePath, Compression: datapackage.CompressionGzip, CompressionLevel: 42}
+	if err := d.Pack(te.DataDir); err == nil {
+		t.Fatalf("packer tests: expected an error packing with an invalid gzip level")
+	}
+}
+
+func TestZip(t *testing.T) {
+	te := NewTestEnv(t, true)
+	defer te.RemoveTestFiles(t)
+
+	// Encrypted, with the container chosen by extension.
+	zipPath := filepath.Join(te.PackageDir, "test.zip.gpg")
+
+	d := &datapackage.DataPackage{PackagePath: zipPath, KeyPath: te.PublicKeyFilePath}
+	if err := d.Pack(te.DataDir); err != nil {
+		t.Fatalf("packer tests: error packing zip file: %v", err)
+	}
+
+	d = &datapackage.DataPackage{PackagePath: zipPath, KeyPath: te.PrivateKeyFilePath, KeyPassPath: te.PrivateKeyPassphrasePath}
+	if err := d.Unpack(te.UnpackDataDir); err != nil {
+		t.Fatalf("packer tests: error unpacking zip file: %v", err)
+	}
+
+	te.VerifyUnpack(t)
+
+	// Unencrypted and stored, with the container chosen by option, which is
+	// read in place.
+	os.RemoveAll(te.UnpackDataDir)
+
+	pkgPath := filepath.Join(te.PackageDir, "test.pkg")
+
+	d = &datapackage.DataPackage{PackagePath: pkgPath, Container: datapackage.ContainerZip, Compression: datapackage.CompressionNone}
+	if err := d.Pack(te.DataDir); err != nil {
+		t.Fatalf("packer tests: error packing zip file: %v", err)
+	}
+
+	r, err := zip.OpenReader(pkgPath)
+	if err != nil {
+		t.Fatalf("packer tests: package is not a zip file: %v", err)
+	}
+	if len(r.File) != 3 || r.File[2].Name != datapackage.ManifestName {
+		t.Fatalf("packer tests: unexpected zip entries: %d", len(r.File))
+	}
+	r.Close()
+
+	d = &datapackage.DataPackage{PackagePath: pkgPath}
+	if err = d.Unpack(te.UnpackDataDir); err != nil {
+		t.Fatalf("packer tests: error unpacking zip file: %v", err)
+	}
+
+	te.VerifyUnpack(t)
+
+	// A truncated zip file is an error rather than a panic, whether it is
+	// read in place or copied first.
+	content, err := ioutil.ReadFile(pkgPath)
+	if err != nil {
+		t.Fatalf("packer tests: error reading zip file: %v", err)
+	}
+	truncated := content[:len(content)/2]
+
+	gzipped := new(bytes.Buffer)
+	gw := gzip.NewWriter(gzipped)
+	gw.Write(truncated)
+	gw.Close()
+
+	for _, b := range [][]byte{truncated, gzipped.Bytes()} {
+		if err = ioutil.WriteFile(pkgPath, b, 0644); err != nil {
+			t.Fatalf("packer tests: error writing zip file: %v", err)
+		}
+
+		d = &datapackage.DataPackage{PackagePath: pkgPath}
+		if _, err = d.List(); err != zip.ErrFormat {
+			t.Fatalf("packer tests: expected zip.ErrFormat listing a truncated zip file, got %v", err)
+		}
+		if err = d.Unpack(filepath.Join(te.UnpackDataDir, "truncated")); err != zip.ErrFormat {
+			t.Fatalf("packer tests: expected zip.ErrFormat unpacking a truncated zip file, got %v", err)
+		}
+		if _, err = datapackage.OpenFS(d); err != zip.ErrFormat {
+			t.Fatalf("packer tests: expected zip.ErrFormat opening a truncated zip file, got %v", err)
+		}
+	}
+
+	d = &datapackage.DataPackage{PackagePath: zipPath + ".zst", Container: datapackage.ContainerZip, Compression: datapackage.CompressionZstd}
+	if err = d.Pack(te.DataDir); err == nil {
+		t.Fatalf("packer tests: expected an error packing a zip file with zstd")
+	}
+}
+
+// writeGeneratedKey generates a new unprotected key pair for email and writes
+// the armored public and private keys to temporary files, returning their
+// names.
+func writeGeneratedKey(t *testing.T, email string) (publicKeyPath string, privateKeyPath string) {
+	config := &packet.Config{DefaultHash: crypto.SHA256, DefaultCipher: packet.CipherAES256}
+
+	entity, err := openpgp.NewEntity("Generated", "", email, config)
+	if err != nil {
+		t.Fatalf("packer tests: error generating key: %v", err)
+	}
+
+	publicBuf := new(bytes.Buffer)
+	privateBuf := new(bytes.Buffer)
+
+	w, err := armor.Encode(privateBuf, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatalf("packer tests: error armoring key: %v", err)
+	}
+	if err = entity.SerializePrivate(w, nil); err != nil {
+		t.Fatalf("packer tests: error serializing key: %v", err)
+	}
+	w.Close()
+
+	if w, err = armor.Encode(publicBuf, openpgp.PublicKeyType, nil); err != nil {
+		t.Fatalf("packer tests: error armoring key: %v", err)
+	}
+	if err = entity.Serialize(w); err != nil {
+		t.Fatalf("packer tests: error serializing key: %v", err)
+	}
+	w.Close()
+
+	publicKeyPath = writeTempFile(t, "generated.public.key", publicBuf.String())
+	privateKeyPath = writeTempFile(t, "generated.private.key", privateBuf.String())
+
+	return
+}
+
+func TestSignature(t *testing.T) {
+	te := NewTestEnv(t, true)
+	defer te.RemoveTestFiles(t)
+
+	untrustedKeyPath, untrustedPrivateKeyPath := writeGeneratedKey(t, "untrusted@test.er")
+	defer os.Remove(untrustedKeyPath)
+	defer os.Remove(untrustedPrivateKeyPath)
+
+	// Signed packages are recognized by their contents, whatever their
+	// extension, with or without trusted signers.
+	tests := []struct {
+		name        string
+		ext         string
+		encrypt     bool
+		sign        bool
+		trustedPath string
+		err         error
+	}{
+		{"encrypted and signed", ".tar.gz.gpg", true, true, te.PublicKeyFilePath, nil},
+		{"signed only", ".tar.gz.gpg", false, true, te.PublicKeyFilePath, nil},
+		{"signed only without extension", ".pkg", false, true, te.PublicKeyFilePath, nil},
+		{"signed only unchecked", ".tar.gz.gpg", false, true, "", nil},
+		{"signed only unchecked without extension", ".pkg", false, true, "", nil},
+		{"unsigned", ".tar.gz.gpg", true, false, te.PublicKeyFilePath, datapackage.ErrUnsigned},
+		{"plain", ".tar.gz", false, false, te.PublicKeyFilePath, datapackage.ErrUnsigned},
+		{"untrusted", ".tar.gz.gpg", true, true, untrustedKeyPath, datapackage.ErrUntrustedSigner},
+		{"signed only untrusted", ".pkg", false, true, untrustedKeyPath, datapackage.ErrUntrustedSigner},
+	}
+
+	for i, test := range tests {
+		packagePath := filepath.Join(te.PackageDir, test.name+test.ext)
+		unpackDir := filepath.Join(te.UnpackDataDir, test.name)
+
+		d := &datapackage.DataPackage{PackagePath: packagePath, KeyPassPath: te.PrivateKeyPassphrasePath}
+		if test.encrypt {
+			d.KeyPath = te.PublicKeyFilePath
+		}
+		if test.sign {
+			d.SigningKeyPath = te.PrivateKeyFilePath
+		}
+
+		if err := d.Pack(te.DataDir); err != nil {
+			t.Fatalf("packer tests: %s: error packing file: %v", test.name, err)
+		}
+
+		d = &datapackage.DataPackage{
+			PackagePath:        packagePath,
+			KeyPassPath:        te.PrivateKeyPassphrasePath,
+			TrustedSignersPath: test.trustedPath,
+		}
+		if test.encrypt {
+			d.KeyPath = te.PrivateKeyFilePath
+		}
+
+		err := d.Unpack(unpackDir)
+
+		if test.err == nil {
+			if err != nil {
+				t.Fatalf("packer tests: %s: error unpacking file: %v", test.name, err)
+			}
+			content, err := ioutil.ReadFile(filepath.Join(unpackDir, "datafile1.csv"))
+			if err != nil || string(content) != testMsg {
+				t.Fatalf("packer tests: %s: datafile1.csv not successfully unpacked: %v", test.name, err)
+			}
+			if test.trustedPath == "" {
+				if d.SignedBy != nil {
+					t.Fatalf("packer tests: %s: signer recorded without trusted signers", test.name)
+				}
+				continue
+			}
+			if d.SignedBy == nil || !strings.Contains(d.SignedBy.UserID, testKeyEmail) {
+				t.Fatalf("packer tests: %s: unexpected signer %v", test.name, d.SignedBy)
+			}
+			continue
+		}
+
+		var signatureErr *datapackage.SignatureError
+		if !errors.As(err, &signatureErr) || !errors.Is(err, test.err) {
+			t.Fatalf("packer tests: case %d: %s: expected %v, got %v", i, test.name, test.err, err)
+		}
+		if d.SignedBy != nil {
+			t.Fatalf("packer tests: %s: signer recorded for rejected package", test.name)
+		}
+	}
+}
+
+func TestMultipleRecipients(t *testing.T) {
+	te := NewTestEnv(t, true)
+	defer te.RemoveTestFiles(t)
+
+	archivePublicKeyPath, archivePrivateKeyPath := writeGeneratedKey(t, "archive@test.er")
+	defer os.Remove(archivePublicKeyPath)
+	defer os.Remove(archivePrivateKeyPath)
+
+	d := &datapackage.DataPackage{
+		PackagePath:       te.PackagePath,
+		KeyPath:           te.PublicKeyFilePath,
+		RecipientKeyPaths: []string{archivePublicKeyPath},
+	}
+
+	if err := d.Pack(te.DataDir); err != nil {
+		t.Fatalf("packer tests: error packing file: %v", err)
+	}
+
+	// Each recipient can decrypt the package with their own private key.
+	for i, keyPath := range []string{te.PrivateKeyFilePath, archivePrivateKeyPath} {
+		d = &datapackage.DataPackage{PackagePath: te.PackagePath, KeyPath: keyPath}
+		if keyPath == te.PrivateKeyFilePath {
+			d.KeyPassPath = te.PrivateKeyPassphrasePath
+		}
+
+		if err := d.Unpack(filepath.Join(te.UnpackDataDir, strconv.Itoa(i))); err != nil {
+			t.Fatalf("packer tests: error unpacking file with %s: %v", keyPath, err)
+		}
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	te := NewTestEnv(t, true)
+	defer te.RemoveTestFiles(t)
+
+	otherPublicKeyPath, otherPrivateKeyPath := writeGeneratedKey(t, "other@test.er")
+	defer os.Remove(otherPublicKeyPath)
+	defer os.Remove(otherPrivateKeyPath)
+
+	// The keyring directory holds an unrelated key ahead of the right one, and
+	// the passphrase directory holds the passphrase under the right key's ID.
+	keyringDir, err := ioutil.TempDir("", "testkeyring")
+	if err != nil {
+		t.Fatalf("packer tests: can't create temporary directory")
+	}
+	defer os.RemoveAll(keyringDir)
+
+	if err = os.Rename(otherPrivateKeyPath, filepath.Join(keyringDir, "a-other.asc")); err != nil {
+		t.Fatalf("packer tests: error moving key: %v", err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(keyringDir, "b-testy.asc"), []byte(testPrivateKey), 0600); err != nil {
+		t.Fatalf("packer tests: error writing key: %v", err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(keyringDir, "README"), []byte("not a key"), 0600); err != nil {
+		t.Fatalf("packer tests: error writing file: %v", err)
+	}
+
+	passDir, err := ioutil.TempDir("", "testkeypass")
+	if err != nil {
+		t.Fatalf("packer tests: can't create temporary directory")
+	}
+	defer os.RemoveAll(passDir)
+
+	if err = ioutil.WriteFile(filepath.Join(passDir, testKeyID), []byte(testPrivateKeyPassphrase+"\n"), 0600); err != nil {
+		t.Fatalf("packer tests: error writing passphrase: %v", err)
+	}
+
+	d := &datapackage.DataPackage{PackagePath: te.PackagePath, KeyPath: te.PublicKeyFilePath}
+	if err = d.Pack(te.DataDir); err != nil {
+		t.Fatalf("packer tests: error packing file: %v", err)
+	}
+
+	d = &datapackage.DataPackage{PackagePath: te.PackagePath, KeyringPaths: []string{keyringDir}, KeyPassDir: passDir}
+	if err = d.Unpack(te.UnpackDataDir); err != nil {
+		t.Fatalf("packer tests: error unpacking file: %v", err)
+	}
+
+	te.VerifyUnpack(t)
+
+	if d.DecryptedBy == nil || d.DecryptedBy.KeyID != testKeyID {
+		t.Fatalf("packer tests: package decrypted by %v, expected key %s", d.DecryptedBy, testKeyID)
+	}
+
+	// A keyring without the recipient's key cannot decrypt the package.
+	d = &datapackage.DataPackage{PackagePath: te.PackagePath, KeyringPaths: []string{filepath.Join(keyringDir, "a-other.asc")}}
+	if err = d.Unpack(filepath.Join(te.UnpackDataDir, "other")); !errors.Is(err, datapackage.ErrNoMatchingKey) {
+		t.Fatalf("packer tests: expected ErrNoMatchingKey, got %v", err)
+	}
+}
+
+func ExampleDataPackage_Pack() {
+	d := &datapackage.DataPackage{
+		PackagePath:    "/home/user/datapackage.tar.gz.gpg",
+		PublicKeyEmail: "testy@test.er",
+	}
+
+	d.Pack("/home/user/datadirectory")
+}
+
+func ExampleDataPackage_Unpack() {
+	d := &datapackage.DataPackage{
+		PackagePath: "/home/user/datapackage.tar.gz.gpg",
+		KeyPath:     "/home/user/keys/public_and_private.asc",
+		KeyPassPath: "/home/user/keys/pass.txt",
+	}
+
+	d.Unpack("/home/user/datadirectory")
+}
+
+func ExampleOpenFS() {
+	d := &datapackage.DataPackage{
+		PackagePath: "/home/user/datapackage.tar.gz.gpg",
+		KeyPath:     "/home/user/keys/public_and_private.asc",
+		KeyPassPath: "/home/user/keys/pass.txt",
+	}
+
+	fsys, err := datapackage.OpenFS(d)
+	if err != nil {
+		return
+	}
+
+	// Close removes the temporary copy of the files.
+	defer fsys.Close()
+
+	fs.WalkDir(fsys, ".", func(path string, entry fs.DirEntry, err error) error {
+		fmt.Println(path)
+		return err
+	})
+}
+
+// Email address used for test key pair below
+const testKeyEmail = "testy@test.er"
+
+// Key ID of the primary key of the test key pair below
+const testKeyID = "924A2F0681FC218A"
 
 // Public key for "Testy Tester"<testy@test.er>
 const testPublicKey = `-----BEGIN PGP PUBLIC KEY BLOCK-----
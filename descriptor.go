@@ -0,0 +1,191 @@
+package datapackage
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DescriptorName is the name of the Frictionless Data Package descriptor that
+// Pack writes when DataPackage.WriteDescriptor is set. Unlike the manifest, it
+// is extracted by Unpack along with the data files.
+const DescriptorName = "datapackage.json"
+
+// ErrNoDescriptor is returned by ReadDescriptor when the package does not
+// contain a descriptor.
+var ErrNoDescriptor = errors.New("datapackage: package has no " + DescriptorName)
+
+// Descriptor is a Frictionless Data Package descriptor describing every file
+// in a package as a tabular data resource. See
+// https://specs.frictionlessdata.io/data-package/ for the specification.
+type Descriptor struct {
+	Profile   string     `json:"profile,omitempty"`
+	Name      string     `json:"name"`
+	Resources []Resource `json:"resources"`
+}
+
+// Resource is a tabular data resource within a Descriptor.
+type Resource struct {
+	Profile   string   `json:"profile,omitempty"`
+	Name      string   `json:"name"`
+	Path      string   `json:"path"`
+	Format    string   `json:"format,omitempty"`
+	MediaType string   `json:"mediatype,omitempty"`
+	Encoding  string   `json:"encoding,omitempty"`
+	Bytes     int64    `json:"bytes"`
+	Hash      string   `json:"hash"` // Prefixed with the algorithm, e.g. "sha256:<hex>".
+	Dialect   *Dialect `json:"dialect,omitempty"`
+	Schema    *Schema  `json:"schema,omitempty"`
+}
+
+// Dialect is a CSV dialect description of a Resource.
+type Dialect struct {
+	Delimiter      string `json:"delimiter"`
+	LineTerminator string `json:"lineTerminator"`
+	QuoteChar      string `json:"quoteChar"`
+	DoubleQuote    bool   `json:"doubleQuote"`
+	Header         bool   `json:"header"`
+}
+
+// Schema is a Table Schema describing the fields of a Resource.
+type Schema struct {
+	Fields []Field `json:"fields"`
+}
+
+// Field is a single column of a Schema. Types are not inferred from the data,
+// so every field is described as a string.
+type Field struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// headerSizeMax is the most bytes of a file that are kept to infer the schema
+// of its resource from the header row.
+const headerSizeMax = 64 << 10
+
+// newResource describes the CSV file stored in the package as relPath, of
+// which head holds the start, as a tabular data resource. The schema is
+// inferred from the header row of the file.
+func newResource(relPath string, head []byte, size int64, sha256Hex string) (Resource, error) {
+	name := filepath.ToSlash(relPath)
+
+	r := Resource{
+		Profile:   "tabular-data-resource",
+		Name:      descriptorName(strings.TrimSuffix(name, path.Ext(name))),
+		Path:      name,
+		Format:    "csv",
+		MediaType: "text/csv",
+		Encoding:  "utf-8",
+		Bytes:     size,
+		Hash:      "sha256:" + sha256Hex,
+		Dialect: &Dialect{
+			Delimiter:      ",",
+			LineTerminator: "\n",
+			QuoteChar:      "\"",
+			DoubleQuote:    true,
+			Header:         true,
+		},
+		Schema: &Schema{Fields: []Field{}},
+	}
+
+	// Detect the line terminator from the end of the header row.
+	line := string(head)
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i+1]
+	}
+	if strings.HasSuffix(line, "\r\n") {
+		r.Dialect.LineTerminator = "\r\n"
+	}
+
+	header, err := csv.NewReader(strings.NewReader(line)).Read()
+	if err == io.EOF {
+		return r, nil
+	}
+	if err != nil {
+		return r, fmt.Errorf("descriptor: error reading header row of '%s': %v", relPath, err)
+	}
+
+	for _, column := range header {
+		r.Schema.Fields = append(r.Schema.Fields, Field{Name: column, Type: "string"})
+	}
+
+	return r, nil
+}
+
+// addResource adds r to the resources of desc. Resource names must be unique,
+// but different paths can map to the same name, such as a/b.csv and a-b.csv,
+// so a taken name is given a numeric suffix.
+func (desc *Descriptor) addResource(r Resource) {
+	name := r.Name
+	for i := 2; desc.hasResource(r.Name); i++ {
+		r.Name = name + "-" + strconv.Itoa(i)
+	}
+
+	desc.Resources = append(desc.Resources, r)
+}
+
+// hasResource reports whether desc has a resource with the given name.
+func (desc *Descriptor) hasResource(name string) bool {
+	for _, r := range desc.Resources {
+		if r.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// descriptorName converts s into a valid descriptor name, which may only
+// contain lowercase alphanumeric characters and '.', '_' or '-'.
+func descriptorName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		default:
+			return '-'
+		}
+	}, s)
+}
+
+// ReadDescriptor reads the Frictionless Data Package descriptor from the
+// package without extracting any files. It returns ErrNoDescriptor if the
+// package does not contain one. Since it stops reading at the descriptor, the
+// package signature and manifest are not checked.
+func (d *DataPackage) ReadDescriptor() (*Descriptor, error) {
+
+	if err := d.openReader(); err != nil {
+		return nil, err
+	}
+
+	defer d.finishUnpack()
+
+	for {
+		fileHeader, err := d.next()
+		if err == io.EOF {
+			return nil, ErrNoDescriptor
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if fileHeader.Name != DescriptorName {
+			continue
+		}
+
+		desc := new(Descriptor)
+
+		if err = json.NewDecoder(d.archiveReader).Decode(desc); err != nil {
+			return nil, fmt.Errorf("descriptor: error decoding %s: %v", DescriptorName, err)
+		}
+
+		return desc, nil
+	}
+}
@@ -0,0 +1,35 @@
+package datapackage
+
+import (
+	"archive/tar"
+	"syscall"
+)
+
+// sameDevice reports whether the files at a and b are on the same file system,
+// so that one can be renamed next to the other.
+func sameDevice(a string, b string) bool {
+	var sa, sb syscall.Stat_t
+	if syscall.Stat(a, &sa) != nil || syscall.Stat(b, &sb) != nil {
+		return false
+	}
+	return sa.Dev == sb.Dev
+}
+
+// mknod creates the device or FIFO entry hdr at path.
+func mknod(path string, hdr *tar.Header) error {
+	mode := uint32(hdr.Mode & 07777)
+
+	switch hdr.Typeflag {
+	case tar.TypeChar:
+		mode |= syscall.S_IFCHR
+	case tar.TypeBlock:
+		mode |= syscall.S_IFBLK
+	case tar.TypeFifo:
+		mode |= syscall.S_IFIFO
+	}
+
+	major, minor := uint64(hdr.Devmajor), uint64(hdr.Devminor)
+	dev := (major&0xfffff000)<<32 | (major&0xfff)<<8 | (minor&0xffffff00)<<12 | minor&0xff
+
+	return syscall.Mknod(path, mode, int(dev))
+}
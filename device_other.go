@@ -0,0 +1,21 @@
+//go:build !linux
+
+package datapackage
+
+import (
+	"archive/tar"
+	"fmt"
+	"runtime"
+)
+
+// sameDevice reports whether the files at a and b are on the same file system,
+// which is assumed on platforms other than Linux.
+func sameDevice(a string, b string) bool {
+	return true
+}
+
+// mknod creates the device or FIFO entry hdr at path, which is only supported
+// on Linux.
+func mknod(path string, hdr *tar.Header) error {
+	return fmt.Errorf("creating '%s': device entries are not supported on %s", path, runtime.GOOS)
+}
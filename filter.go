@@ -0,0 +1,158 @@
+package datapackage
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// PackIgnoreName is the name of the file in the root of the data directory
+// that lists further Exclude patterns for Pack, one per line. Blank lines and
+// lines starting with '#' are ignored. The file itself is never packed.
+const PackIgnoreName = ".packignore"
+
+// UnmatchedPolicy is what Pack does with a file that is neither excluded nor
+// matched by the Include patterns or Extensions.
+type UnmatchedPolicy string
+
+// Unmatched file policies.
+const (
+	UnmatchedError   UnmatchedPolicy = "error"   // Fail the Pack (the default).
+	UnmatchedSkip    UnmatchedPolicy = "skip"    // Leave the file out and log a warning.
+	UnmatchedInclude UnmatchedPolicy = "include" // Pack the file anyway.
+)
+
+// defaultExtensions are the extensions Pack accepts when neither Include nor
+// Extensions is given.
+var defaultExtensions = []string{".csv"}
+
+// fileFilter decides which files in a data directory Pack packs.
+type fileFilter struct {
+	include    []string
+	exclude    []string
+	extensions []string
+	unmatched  UnmatchedPolicy
+}
+
+// newFileFilter returns the filter for packing dataDirPath, checking every
+// pattern and reading the exclude patterns in its .packignore file, if any.
+func (d *DataPackage) newFileFilter(dataDirPath string) (*fileFilter, error) {
+	f := &fileFilter{
+		include:    d.Include,
+		exclude:    append([]string{PackIgnoreName}, d.Exclude...),
+		extensions: d.Extensions,
+		unmatched:  d.OnUnmatched,
+	}
+
+	if len(f.include) == 0 && len(f.extensions) == 0 {
+		f.extensions = defaultExtensions
+	}
+
+	switch f.unmatched {
+	case "":
+		f.unmatched = UnmatchedError
+	case UnmatchedError, UnmatchedSkip, UnmatchedInclude:
+	default:
+		return nil, fmt.Errorf("unknown unmatched file policy '%s'", f.unmatched)
+	}
+
+	ignored, err := readPackIgnore(filepath.Join(dataDirPath, PackIgnoreName))
+	if err != nil {
+		return nil, err
+	}
+	f.exclude = append(f.exclude, ignored...)
+
+	for _, patterns := range [][]string{f.include, f.exclude} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(strings.TrimSuffix(pattern, "/"), ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern '%s': %v", pattern, err)
+			}
+		}
+	}
+
+	return f, nil
+}
+
+// readPackIgnore reads the patterns in the .packignore file at name, which
+// need not exist.
+func readPackIgnore(name string) ([]string, error) {
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var patterns []string
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading '%s': %v", name, err)
+	}
+
+	return patterns, nil
+}
+
+// excluded reports whether the file or directory at the slash-separated path
+// rel is excluded.
+func (f *fileFilter) excluded(rel string, isDir bool) bool {
+	for _, pattern := range f.exclude {
+		dirOnly := strings.HasSuffix(pattern, "/")
+		if dirOnly && !isDir {
+			continue
+		}
+		if matchPattern(strings.TrimSuffix(pattern, "/"), rel) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matched reports whether the file at the slash-separated path rel matches an
+// Include pattern or has one of the Extensions.
+func (f *fileFilter) matched(rel string) bool {
+	for _, pattern := range f.include {
+		if matchPattern(pattern, rel) {
+			return true
+		}
+	}
+
+	name := strings.ToLower(rel)
+	for _, ext := range f.extensions {
+		if strings.HasSuffix(name, strings.ToLower(ext)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchPattern reports whether the slash-separated path rel matches pattern.
+// A pattern containing a slash is matched against the whole path, and one
+// without against the base name, so that it applies at any depth.
+func matchPattern(pattern string, rel string) bool {
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	name := rel
+	if !strings.Contains(pattern, "/") {
+		name = path.Base(rel)
+	}
+
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
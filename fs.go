@@ -0,0 +1,312 @@
+package datapackage
+
+import (
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// PackageFS is a read-only fs.FS of the files in a package, as returned by
+// OpenFS. It implements fs.ReadDirFS, fs.StatFS and fs.ReadFileFS, and its
+// files implement io.Seeker and io.ReaderAt.
+type PackageFS struct {
+	temp   *os.File
+	nodes  map[string]*fsNode
+	closed bool
+}
+
+// fsNode is a file or directory in a PackageFS.
+type fsNode struct {
+	name     string // Base name, or "." for the root.
+	size     int64
+	mode     fs.FileMode
+	modTime  time.Time
+	offset   int64     // Offset of the contents of a file in the temporary file.
+	children []*fsNode // Entries of a directory, sorted by name.
+}
+
+// OpenFS reads the package d describes to the end, through the same
+// decryption, decompression and verification as Unpack, and returns an fs.FS
+// of its files. The file contents are copied to a temporary file, so that the
+// package can be a stream such as STDIN. The caller must call Close on the
+// returned *PackageFS once done with it to remove the temporary file.
+//
+// Directories are implied by the file paths as well as read from directory
+// entries. Links and devices are left out. The manifest is not part of the
+// FS, but the descriptor, if any, is.
+func OpenFS(d *DataPackage) (*PackageFS, error) {
+	r, err := NewPackageReader(d)
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	temp, err := ioutil.TempFile("", "datapackage-fs-")
+	if err != nil {
+		return nil, err
+	}
+
+	p := &PackageFS{
+		temp:  temp,
+		nodes: map[string]*fsNode{".": {name: ".", mode: fs.ModeDir | 0755}},
+	}
+
+	if err = p.index(r); err != nil {
+		p.Close()
+		return nil, err
+	}
+
+	for _, n := range p.nodes {
+		sort.Slice(n.children, func(i, j int) bool {
+			return n.children[i].name < n.children[j].name
+		})
+	}
+
+	return p, nil
+}
+
+// index reads every entry from r, copying the contents of files to the
+// temporary file.
+func (p *PackageFS) index(r *PackageReader) error {
+	var offset int64
+
+	for {
+		entry, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		rel, ok := localPath(entry.Name)
+		if !ok || rel == "." {
+			return &UnsafeEntryError{Name: entry.Name, Err: ErrPathTraversal}
+		}
+		name := filepath.ToSlash(rel)
+
+		switch {
+		case entry.Mode.IsDir():
+			if _, err = p.mkdir(name, entry); err != nil {
+				return err
+			}
+
+		case entry.Mode.IsRegular():
+			dir, err := p.mkdir(path.Dir(name), nil)
+			if err != nil {
+				return err
+			}
+			if _, ok := p.nodes[name]; ok {
+				return &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+			}
+
+			n, err := io.Copy(p.temp, r)
+			if err != nil {
+				return err
+			}
+
+			node := &fsNode{
+				name:    path.Base(name),
+				size:    n,
+				mode:    entry.Mode.Perm(),
+				modTime: entry.ModTime,
+				offset:  offset,
+			}
+			p.nodes[name] = node
+			dir.children = append(dir.children, node)
+
+			offset += n
+		}
+	}
+}
+
+// mkdir returns the directory node for name, creating it and its parents as
+// needed. If entry is given, its mode and modification time are used.
+func (p *PackageFS) mkdir(name string, entry *Entry) (*fsNode, error) {
+	node, ok := p.nodes[name]
+	if ok && !node.mode.IsDir() {
+		return nil, &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+
+	if !ok {
+		parent, err := p.mkdir(path.Dir(name), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		node = &fsNode{name: path.Base(name), mode: fs.ModeDir | 0755}
+		p.nodes[name] = node
+		parent.children = append(parent.children, node)
+	}
+
+	if entry != nil {
+		node.mode = fs.ModeDir | entry.Mode.Perm()
+		node.modTime = entry.ModTime
+	}
+
+	return node, nil
+}
+
+// lookup returns the node for name, or an *fs.PathError for op.
+func (p *PackageFS) lookup(op string, name string) (*fsNode, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	node, ok := p.nodes[name]
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+
+	return node, nil
+}
+
+// Open opens the named file or directory.
+func (p *PackageFS) Open(name string) (fs.File, error) {
+	node, err := p.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if node.mode.IsDir() {
+		return &fsDir{node: node}, nil
+	}
+
+	return &fsFile{SectionReader: io.NewSectionReader(p.temp, node.offset, node.size), node: node}, nil
+}
+
+// Stat returns a fs.FileInfo describing the named file or directory.
+func (p *PackageFS) Stat(name string) (fs.FileInfo, error) {
+	node, err := p.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	return node, nil
+}
+
+// ReadDir reads the named directory and returns its entries sorted by name.
+func (p *PackageFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	node, err := p.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !node.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	entries := make([]fs.DirEntry, len(node.children))
+	for i, child := range node.children {
+		entries[i] = child
+	}
+
+	return entries, nil
+}
+
+// ReadFile returns the contents of the named file.
+func (p *PackageFS) ReadFile(name string) ([]byte, error) {
+	node, err := p.lookup("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if node.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: fs.ErrInvalid}
+	}
+
+	b := make([]byte, node.size)
+	if _, err = p.temp.ReadAt(b, node.offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// Close removes the temporary copy of the file contents. Files opened from
+// the FS can no longer be read.
+func (p *PackageFS) Close() error {
+	if p.closed {
+		return nil
+	}
+
+	p.closed = true
+
+	name := p.temp.Name()
+	err := p.temp.Close()
+
+	if rerr := os.Remove(name); err == nil {
+		err = rerr
+	}
+
+	return err
+}
+
+// fsNode implements fs.FileInfo and fs.DirEntry.
+
+func (n *fsNode) Name() string               { return n.name }
+func (n *fsNode) Size() int64                { return n.size }
+func (n *fsNode) Mode() fs.FileMode          { return n.mode }
+func (n *fsNode) ModTime() time.Time         { return n.modTime }
+func (n *fsNode) IsDir() bool                { return n.mode.IsDir() }
+func (n *fsNode) Sys() interface{}           { return nil }
+func (n *fsNode) Type() fs.FileMode          { return n.mode.Type() }
+func (n *fsNode) Info() (fs.FileInfo, error) { return n, nil }
+
+// fsFile is an open file in a PackageFS.
+type fsFile struct {
+	*io.SectionReader
+	node *fsNode
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) { return f.node, nil }
+func (f *fsFile) Close() error               { return nil }
+
+// fsDir is an open directory in a PackageFS.
+type fsDir struct {
+	node *fsNode
+	pos  int
+}
+
+func (d *fsDir) Stat() (fs.FileInfo, error) { return d.node, nil }
+func (d *fsDir) Close() error               { return nil }
+
+func (d *fsDir) Read(b []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.node.name, Err: fs.ErrInvalid}
+}
+
+// ReadDir returns the next n entries of the directory, or all remaining
+// entries if n <= 0, as fs.ReadDirFile specifies.
+func (d *fsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.node.children[d.pos:]
+
+	if n > 0 {
+		if len(rest) == 0 {
+			return nil, io.EOF
+		}
+		if n < len(rest) {
+			rest = rest[:n]
+		}
+	}
+
+	entries := make([]fs.DirEntry, len(rest))
+	for i, child := range rest {
+		entries[i] = child
+	}
+	d.pos += len(rest)
+
+	return entries, nil
+}
+
+var (
+	_ fs.ReadDirFS   = (*PackageFS)(nil)
+	_ fs.StatFS      = (*PackageFS)(nil)
+	_ fs.ReadFileFS  = (*PackageFS)(nil)
+	_ fs.ReadDirFile = (*fsDir)(nil)
+)
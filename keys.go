@@ -0,0 +1,235 @@
+package datapackage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// KeyIdentity identifies an OpenPGP key by its fingerprint, key ID and user ID.
+type KeyIdentity struct {
+	Fingerprint string // Hex-encoded fingerprint of the primary key.
+	KeyID       string // Hex-encoded 64-bit key ID of the primary key.
+	UserID      string // Primary user ID, e.g. "Testy Tester <testy@test.er>".
+}
+
+func (k *KeyIdentity) String() string {
+	return fmt.Sprintf("%s %s", k.Fingerprint, k.UserID)
+}
+
+// identify returns the identity of an OpenPGP entity.
+func identify(entity *openpgp.Entity) *KeyIdentity {
+	k := &KeyIdentity{
+		Fingerprint: fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint),
+		KeyID:       fmt.Sprintf("%016X", entity.PrimaryKey.KeyId),
+	}
+
+	// Prefer the identity flagged as primary, falling back to the first by
+	// name so the result is stable.
+	names := make([]string, 0, len(entity.Identities))
+	for name, ident := range entity.Identities {
+		if ident.SelfSignature != nil && ident.SelfSignature.IsPrimaryId != nil && *ident.SelfSignature.IsPrimaryId {
+			k.UserID = name
+			return k
+		}
+		names = append(names, name)
+	}
+
+	if len(names) > 0 {
+		sort.Strings(names)
+		k.UserID = names[0]
+	}
+
+	return k
+}
+
+// ErrUnsigned is wrapped by a *SignatureError when a package that must be
+// signed carries no signature.
+var ErrUnsigned = errors.New("package is not signed")
+
+// ErrUntrustedSigner is wrapped by a *SignatureError when a package is signed
+// by a key that is not among the trusted signers.
+var ErrUntrustedSigner = errors.New("package is signed by an untrusted key")
+
+// SignatureError reports a package whose signature could not be verified.
+type SignatureError struct {
+	KeyID string // Hex-encoded key ID of the signing key, if the package is signed.
+	Err   error  // ErrUnsigned, ErrUntrustedSigner or the verification error.
+}
+
+func (e *SignatureError) Error() string {
+	if e.KeyID != "" {
+		return fmt.Sprintf("signature: key %s: %v", e.KeyID, e.Err)
+	}
+	return fmt.Sprintf("signature: %v", e.Err)
+}
+
+func (e *SignatureError) Unwrap() error {
+	return e.Err
+}
+
+// ErrNoMatchingKey is returned by Unpack when none of the private keys in the
+// keyring is one the package is encrypted to.
+var ErrNoMatchingKey = errors.New("no private key in the keyring matches the package recipients")
+
+// keyRingExts are the extensions of the files read from keyring directories.
+var keyRingExts = map[string]bool{".asc": true, ".gpg": true, ".key": true, ".pgp": true}
+
+// readKeyRingFile reads an ASCII-armored or binary keyring from the file at
+// path.
+func readKeyRingFile(path string) (openpgp.EntityList, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entityList openpgp.EntityList
+
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("-----BEGIN")) {
+		entityList, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(b))
+	} else {
+		entityList, err = openpgp.ReadKeyRing(bytes.NewReader(b))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading keyring '%s': %v", path, err)
+	}
+
+	return entityList, nil
+}
+
+// readKeyRingPath reads the keyring file at path or, if path is a directory,
+// every file in it with a keyring extension (.asc, .gpg, .key or .pgp).
+func readKeyRingPath(path string) (openpgp.EntityList, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.IsDir() {
+		return readKeyRingFile(path)
+	}
+
+	fis, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keyring openpgp.EntityList
+
+	for _, fi := range fis {
+		if fi.IsDir() || !keyRingExts[strings.ToLower(filepath.Ext(fi.Name()))] {
+			continue
+		}
+
+		entityList, err := readKeyRingFile(filepath.Join(path, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		keyring = append(keyring, entityList...)
+	}
+
+	return keyring, nil
+}
+
+// decryptionKeys returns the keyring to decrypt packages with: the keys at
+// KeyPath and at each of KeyringPaths.
+func (d *DataPackage) decryptionKeys() (openpgp.EntityList, error) {
+	var keyring openpgp.EntityList
+
+	paths := d.KeyringPaths
+	if d.KeyPath != "" {
+		paths = append([]string{d.KeyPath}, paths...)
+	}
+
+	for _, path := range paths {
+		entityList, err := readKeyRingPath(path)
+		if err != nil {
+			return nil, err
+		}
+
+		keyring = append(keyring, entityList...)
+	}
+
+	return keyring, nil
+}
+
+// passphrase returns the private key passphrase from the PACKER_KEYPASS
+// environment variable or the file at KeyPassPath, in that order of
+// preference, or an empty passphrase if neither is given.
+func (d *DataPackage) passphrase() ([]byte, error) {
+	// TODO: shouldn't the env variables be resolved by something else and stuffed into the Config object?
+	if os.Getenv("PACKER_KEYPASS") != "" {
+		return bytes.TrimSpace([]byte(os.Getenv("PACKER_KEYPASS"))), nil
+	}
+
+	if d.KeyPassPath == "" {
+		return nil, nil
+	}
+
+	passphrase, err := ioutil.ReadFile(d.KeyPassPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSpace(passphrase), nil
+}
+
+// keyPassphrase returns the passphrase for a private key. It looks for a
+// PACKER_KEYPASS_<KEYID> environment variable and then a file named <KEYID> in
+// KeyPassDir, trying the key's own ID and then that of its primary key, and
+// falls back to the passphrase from PACKER_KEYPASS or KeyPassPath. Key IDs are
+// 16 uppercase hex digits.
+func (d *DataPackage) keyPassphrase(key openpgp.Key) ([]byte, error) {
+	keyIDs := []string{fmt.Sprintf("%016X", key.PublicKey.KeyId)}
+	if key.Entity != nil && key.Entity.PrimaryKey.KeyId != key.PublicKey.KeyId {
+		keyIDs = append(keyIDs, fmt.Sprintf("%016X", key.Entity.PrimaryKey.KeyId))
+	}
+
+	for _, keyID := range keyIDs {
+		if pass := os.Getenv("PACKER_KEYPASS_" + keyID); pass != "" {
+			return bytes.TrimSpace([]byte(pass)), nil
+		}
+
+		if d.KeyPassDir == "" {
+			continue
+		}
+
+		pass, err := ioutil.ReadFile(filepath.Join(d.KeyPassDir, keyID))
+		if err == nil {
+			return bytes.TrimSpace(pass), nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	return d.passphrase()
+}
+
+// unlockEntity decrypts the private key and private subkeys of entity with
+// passphrase, leaving keys that are not encrypted untouched.
+func unlockEntity(entity *openpgp.Entity, passphrase []byte) error {
+	if entity.PrivateKey != nil && entity.PrivateKey.Encrypted {
+		if err := entity.PrivateKey.Decrypt(passphrase); err != nil {
+			return err
+		}
+	}
+
+	for _, subkey := range entity.Subkeys {
+		if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+			if err := subkey.PrivateKey.Decrypt(passphrase); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,167 @@
+package datapackage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ratioMinSize is the number of bytes Unpack writes before it starts checking
+// UnpackLimits.MaxRatio, so that small, highly repetitive packages are not
+// rejected.
+const ratioMinSize = 1 << 20
+
+// UnpackLimits bounds the resources Unpack may use, to guard against
+// decompression bombs. A zero value for any limit means no limit.
+//
+// MaxFiles is the number of entries (files, directories, links and devices)
+// that may be extracted, not counting the manifest.
+//
+// MaxFileSize and MaxTotalSize are the number of bytes that may be written for
+// a single file and for all files together.
+//
+// MaxRatio is the ratio of bytes written to bytes read from the package file,
+// once at least 1 MiB has been written.
+//
+// A ZIP package that is compressed or encrypted as a whole is copied to a
+// temporary file before anything is extracted, and the copy counts against
+// MaxTotalSize and MaxRatio as well.
+type UnpackLimits struct {
+	MaxFiles     int     // Maximum number of entries to extract
+	MaxFileSize  int64   // Maximum size of a single file in bytes
+	MaxTotalSize int64   // Maximum size of all files together in bytes
+	MaxRatio     float64 // Maximum ratio of unpacked to packed bytes
+}
+
+// LimitError reports a package that exceeds one of the UnpackLimits. Name is
+// empty if the limit is exceeded while copying a ZIP package, before any entry
+// is extracted.
+type LimitError struct {
+	Name  string // Name of the entry being extracted, as stored in the package.
+	Limit string // Name of the exceeded limit, e.g. "MaxTotalSize".
+}
+
+func (e *LimitError) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("limit: copying package exceeds %s", e.Limit)
+	}
+	return fmt.Sprintf("limit: extracting '%s' exceeds %s", e.Name, e.Limit)
+}
+
+// limiter tracks the resources used by an Unpack against the UnpackLimits.
+type limiter struct {
+	limits  UnpackLimits
+	in      *countingReader
+	files   int
+	total   int64
+	spooled int64
+}
+
+// entry accounts for a new entry with the given header size, which may be
+// checked before anything is written.
+func (l *limiter) entry(name string, size int64) error {
+	l.files++
+
+	switch {
+	case l.limits.MaxFiles > 0 && l.files > l.limits.MaxFiles:
+		return &LimitError{Name: name, Limit: "MaxFiles"}
+	case l.limits.MaxFileSize > 0 && size > l.limits.MaxFileSize:
+		return &LimitError{Name: name, Limit: "MaxFileSize"}
+	case l.limits.MaxTotalSize > 0 && l.total+size > l.limits.MaxTotalSize:
+		return &LimitError{Name: name, Limit: "MaxTotalSize"}
+	}
+
+	return nil
+}
+
+// write checks that n more bytes may be written to an entry of which size
+// bytes have been written already, and accounts for them if so.
+func (l *limiter) write(name string, size int64, n int) error {
+	size += int64(n)
+	total := l.total + int64(n)
+
+	switch {
+	case l.limits.MaxFileSize > 0 && size > l.limits.MaxFileSize:
+		return &LimitError{Name: name, Limit: "MaxFileSize"}
+	case l.limits.MaxTotalSize > 0 && total > l.limits.MaxTotalSize:
+		return &LimitError{Name: name, Limit: "MaxTotalSize"}
+	case l.limits.MaxRatio > 0 && total >= ratioMinSize && float64(total) > l.limits.MaxRatio*float64(l.in.n):
+		return &LimitError{Name: name, Limit: "MaxRatio"}
+	}
+
+	l.total = total
+
+	return nil
+}
+
+// spool checks that n more bytes of the package stream may be copied to a
+// temporary file, and accounts for them if so.
+func (l *limiter) spool(n int) error {
+	spooled := l.spooled + int64(n)
+
+	switch {
+	case l.limits.MaxTotalSize > 0 && spooled > l.limits.MaxTotalSize:
+		return &LimitError{Limit: "MaxTotalSize"}
+	case l.limits.MaxRatio > 0 && spooled >= ratioMinSize && float64(spooled) > l.limits.MaxRatio*float64(l.in.n):
+		return &LimitError{Limit: "MaxRatio"}
+	}
+
+	l.spooled = spooled
+
+	return nil
+}
+
+// spoolReader reads the package stream for copying it to a temporary file,
+// checking the bytes read against the limiter.
+type spoolReader struct {
+	r   io.Reader
+	lim *limiter
+}
+
+func (s *spoolReader) Read(b []byte) (int, error) {
+	n, err := s.r.Read(b)
+	if lerr := s.lim.spool(n); lerr != nil {
+		return 0, lerr
+	}
+	return n, err
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// missingDir returns the outermost directory of dir, or dir itself, that does
+// not exist yet, or an empty string if dir exists.
+func missingDir(dir string) string {
+	missing := ""
+
+	for {
+		if _, err := os.Lstat(dir); err == nil {
+			return missing
+		}
+		missing = dir
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return missing
+		}
+		dir = parent
+	}
+}
+
+// removeAll removes the given paths in reverse order, ignoring errors, to
+// undo a partial Unpack.
+func removeAll(paths []string) {
+	for i := len(paths) - 1; i >= 0; i-- {
+		os.RemoveAll(paths[i])
+	}
+}
@@ -0,0 +1,100 @@
+package datapackage
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ManifestName is the name of the manifest entry that Pack writes as the last
+// member of every package. It is consumed by Unpack rather than extracted.
+const ManifestName = "manifest.json"
+
+// Manifest lists every file in a package with its size and SHA-256 digest.
+// Pack writes it as the last member of the package and Unpack checks each
+// extracted file against it.
+type Manifest struct {
+	Files []ManifestFile `json:"files"`
+}
+
+// ManifestFile describes a single file in a package.
+type ManifestFile struct {
+	Path   string `json:"path"`   // Path relative to the package root, as stored in the package.
+	Size   int64  `json:"size"`   // Size of the file in bytes.
+	SHA256 string `json:"sha256"` // Hex-encoded SHA-256 digest of the file contents.
+}
+
+// ManifestError reports a file that does not match the package manifest,
+// either because its contents differ or because it is missing from one side.
+type ManifestError struct {
+	Path     string        // Path of the offending file.
+	Expected *ManifestFile // Manifest entry, or nil if the file is not listed.
+	Actual   *ManifestFile // File found in the package, or nil if it is missing.
+}
+
+func (e *ManifestError) Error() string {
+	switch {
+	case e.Actual == nil:
+		return fmt.Sprintf("manifest: '%s' is listed in the manifest but missing from the package", e.Path)
+	case e.Expected == nil:
+		return fmt.Sprintf("manifest: '%s' is in the package but not listed in the manifest", e.Path)
+	case e.Expected.Size != e.Actual.Size:
+		return fmt.Sprintf("manifest: '%s' is %d bytes, expected %d", e.Path, e.Actual.Size, e.Expected.Size)
+	default:
+		return fmt.Sprintf("manifest: '%s' has SHA-256 %s, expected %s", e.Path, e.Actual.SHA256, e.Expected.SHA256)
+	}
+}
+
+// verify checks the files read from a package, keyed by path, against the
+// manifest and returns a *ManifestError for the first discrepancy.
+func (m *Manifest) verify(files map[string]ManifestFile) error {
+	listed := make(map[string]bool, len(m.Files))
+
+	for i := range m.Files {
+		expected := &m.Files[i]
+		listed[expected.Path] = true
+
+		actual, ok := files[expected.Path]
+		if !ok {
+			return &ManifestError{Path: expected.Path, Expected: expected}
+		}
+
+		if actual.Size != expected.Size || actual.SHA256 != expected.SHA256 {
+			return &ManifestError{Path: expected.Path, Expected: expected, Actual: &actual}
+		}
+	}
+
+	for path, actual := range files {
+		if !listed[path] {
+			actual := actual
+			return &ManifestError{Path: path, Actual: &actual}
+		}
+	}
+
+	return nil
+}
+
+// writeManifest writes the manifest of the files packed so far as the next
+// entry in the package.
+func (d *DataPackage) writeManifest() error {
+	if d.manifest == nil {
+		d.manifest = new(Manifest)
+	}
+
+	b, err := json.MarshalIndent(d.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return d.writeEntry(ManifestName, b)
+}
+
+// readManifest decodes the manifest from the current entry in the package.
+func (d *DataPackage) readManifest() (*Manifest, error) {
+	m := new(Manifest)
+
+	if err := json.NewDecoder(d.archiveReader).Decode(m); err != nil {
+		return nil, fmt.Errorf("manifest: error decoding %s: %v", ManifestName, err)
+	}
+
+	return m, nil
+}
@@ -0,0 +1,100 @@
+package datapackage
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+)
+
+// defaultDirMode is the mode of directories that Unpack creates without a
+// directory entry in the package, unless DirMode is set.
+const defaultDirMode = 0755
+
+// fileMode returns the permissions to give an extracted file that has mode in
+// the package.
+func (d *DataPackage) fileMode(mode os.FileMode) os.FileMode {
+	if d.FileMode != 0 {
+		return d.FileMode.Perm()
+	}
+	return mode.Perm()
+}
+
+// dirMode returns the permissions to give an extracted directory that has
+// mode in the package, or 0 if it has no directory entry.
+func (d *DataPackage) dirMode(mode os.FileMode) os.FileMode {
+	switch {
+	case d.DirMode != 0:
+		return d.DirMode.Perm()
+	case mode == 0:
+		return defaultDirMode
+	}
+	return mode.Perm()
+}
+
+// restoreOwner gives the extracted entry at path the owner and group of hdr,
+// if RestoreOwner is set and the process runs as root. Symbolic links are not
+// followed.
+func (d *DataPackage) restoreOwner(path string, hdr *tar.Header) error {
+	if !d.RestoreOwner || os.Geteuid() != 0 {
+		return nil
+	}
+	return os.Lchown(path, hdr.Uid, hdr.Gid)
+}
+
+// restoreModTime gives the extracted file at path the modification time of
+// hdr, if RestoreModTime is set. Directories are handled by Unpack once their
+// contents are in place, and links keep the time they were created at.
+func (d *DataPackage) restoreModTime(path string, hdr *tar.Header) error {
+	if !d.RestoreModTime {
+		return nil
+	}
+
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+
+	return os.Chtimes(path, atime, hdr.ModTime)
+}
+
+// setMetadata gives the extracted entry at path the permissions mode and
+// restores its owner and, unless it is a directory, modification time as
+// requested.
+func (d *DataPackage) setMetadata(path string, hdr *tar.Header, mode os.FileMode) error {
+	if err := d.restoreOwner(path, hdr); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+
+	if hdr.Typeflag == tar.TypeDir {
+		return nil
+	}
+
+	return d.restoreModTime(path, hdr)
+}
+
+// mkdirAll creates the directory dir with the given permissions, along with
+// any missing parents, and returns the outermost directory it created, if
+// any. Unlike os.MkdirAll, the permissions are not subject to the umask.
+func mkdirAll(dir string, mode os.FileMode) (string, error) {
+	missing := missingDir(dir)
+	if missing == "" {
+		return "", nil
+	}
+
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return missing, err
+	}
+
+	for p := dir; ; p = filepath.Dir(p) {
+		if err := os.Chmod(p, mode); err != nil {
+			return missing, err
+		}
+		if p == missing {
+			return missing, nil
+		}
+	}
+}
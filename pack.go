@@ -3,120 +3,381 @@ package datapackage
 import (
 	"archive/tar"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
-	"net/http"
-	"net/url"
+	"math/rand"
 	"os"
 	"path/filepath"
-	"strings"
+	"sort"
+	"strconv"
+	"time"
 
 	"golang.org/x/crypto/openpgp"
 )
 
-// writeTarHeader writes a new file header to the package and prepares to write
-// that new file's data on the next write.
-func (d *DataPackage) writeTarHeader(fi os.FileInfo, path string) error {
-	var (
-		tarHeader *tar.Header
-		err       error
-	)
+// writeEntry writes a complete entry with the given name and contents to the
+// package.
+func (d *DataPackage) writeEntry(name string, b []byte) error {
+	tarHeader := &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(b)),
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}
+
+	if d.Reproducible {
+		d.normalizeHeader(tarHeader)
+	}
 
-	// Create tar.Header from file info, adding the path.
-	if tarHeader, err = tar.FileInfoHeader(fi, ""); err != nil {
+	if err := d.archiveWriter.WriteHeader(tarHeader); err != nil {
 		return err
 	}
 
-	tarHeader.Name = path
+	_, err := d.write(b)
+	return err
+}
+
+// writeDescriptor writes the descriptor of the files packed so far as the
+// next entry in the package and records it in the manifest.
+func (d *DataPackage) writeDescriptor() error {
+	b, err := json.MarshalIndent(d.descriptor, "", "  ")
+	if err != nil {
+		return err
+	}
 
-	// Call the WriteHeader method, which prepares the already existing
-	// writer to receive another file.
-	if err = d.tarWriteCloser.WriteHeader(tarHeader); err != nil {
+	if err = d.writeEntry(DescriptorName, b); err != nil {
 		return err
 	}
 
+	sum := sha256.Sum256(b)
+
+	d.manifest.Files = append(d.manifest.Files, ManifestFile{
+		Path:   DescriptorName,
+		Size:   int64(len(b)),
+		SHA256: hex.EncodeToString(sum[:]),
+	})
+
 	return nil
 }
 
 // write writes data to the current entry in the package.
 func (d *DataPackage) write(b []byte) (int, error) {
-	return d.tarWriteCloser.Write(b)
+	return d.archiveWriter.Write(b)
 }
 
-// finishPack closes the package, flushing any unwritten data.
+// openWriter opens a temporary file next to the package file, or STDOUT, and
+// layers encryption and/or signing (if a key is given), compression and tar
+// or ZIP writing on top of it. The temporary file is moved to the package
+// file by finishPack.
+func (d *DataPackage) openWriter() error {
+	// Layers are only assigned once they have been opened, so that abortPack
+	// closes just those.
+
+	// Open the first level of writer, keeping the API for writing and closing
+	// to it consistent regardless of the underlying implementation.
+	if d.PackagePath != "" {
+		// Never replace an existing package. finishPack makes sure of it, but
+		// failing early saves writing the package for nothing.
+		if _, err := os.Lstat(d.PackagePath); err == nil {
+			return &os.PathError{Op: "open", Path: d.PackagePath, Err: os.ErrExist}
+		}
+
+		f, err := createTemp(filepath.Dir(d.PackagePath), "."+filepath.Base(d.PackagePath)+".tmp-", 0644)
+		if err != nil {
+			return err
+		}
+		d.tempFile = f
+		d.outWriteCloser = f
+	} else {
+		d.outWriteCloser = &cutWriter{w: os.Stdout}
+	}
+
+	// Open the encryption and/or signing writer if desired
+	if d.gpgInUse() {
+
+		signer, err := d.signingEntity()
+		if err != nil {
+			return err
+		}
+
+		var enc io.WriteCloser
+
+		if signer != nil && !d.hasRecipients() {
+			if enc, err = sign(d.outWriteCloser, signer); err != nil {
+				return err
+			}
+		} else {
+			recipients, err := d.encryptionKeys()
+			if err != nil {
+				return err
+			}
+			if enc, err = encrypt(d.outWriteCloser, recipients, signer); err != nil {
+				return err
+			}
+		}
+
+		d.encWriteCloser = enc
+
+	}
+
+	// BUG(aaron0browne): The .tar.gz format compressed packages output by
+	// DataPackage.Pack cannot be read by standard tar and gzip tools. The
+	// authors believe this is due to the underlying library implementations.
+	var w io.Writer = d.outWriteCloser
+	if d.encWriteCloser != nil {
+		w = d.encWriteCloser
+	}
+
+	// ZIP compresses each entry itself, so only tar packages are compressed
+	// as a whole.
+	if d.container() == ContainerZip {
+		zw, err := newZipWriter(w, d.Compression, d.CompressionLevel)
+		if err != nil {
+			return err
+		}
+		d.compWriteCloser = nopWriteCloser{w}
+		d.archiveWriter = zw
+	} else {
+		cw, err := newCompressor(w, d.Compression, d.CompressionLevel)
+		if err != nil {
+			return err
+		}
+		if gw, ok := cw.(*gzip.Writer); ok && d.Reproducible {
+			// Leave out the name and time, and claim no operating system.
+			gw.Header = gzip.Header{OS: 255}
+		}
+		d.compWriteCloser = cw
+		d.archiveWriter = tar.NewWriter(cw)
+	}
+
+	return nil
+}
+
+// finishPack writes the descriptor (if requested) and the manifest, closes
+// every layer of the package, flushing any unwritten data, and moves the
+// package file into place once it is safely on disk. Layers are forgotten as
+// they are closed, so that abortPack can clean up after a failure.
 func (d *DataPackage) finishPack() error {
 	var err error
 
-	if err = d.tarWriteCloser.Close(); err != nil {
+	if d.descriptor != nil {
+		if err = d.writeDescriptor(); err != nil {
+			return err
+		}
+	}
+
+	if err = d.writeManifest(); err != nil {
+		return err
+	}
+
+	if err = d.archiveWriter.Close(); err != nil {
 		return err
 	}
+	d.archiveWriter = nil
 
-	if err = d.gzipWriteCloser.Close(); err != nil {
+	if err = d.compWriteCloser.Close(); err != nil {
 		return err
 	}
+	d.compWriteCloser = nil
 
 	if d.encWriteCloser != nil {
 		if err = d.encWriteCloser.Close(); err != nil {
 			return err
 		}
+		d.encWriteCloser = nil
+	}
+
+	if d.tempFile == nil {
+		if err = d.outWriteCloser.Close(); err != nil {
+			return err
+		}
+		d.outWriteCloser = nil
+		return nil
 	}
 
-	if err = d.outWriteCloser.Close(); err != nil {
+	if err = d.tempFile.Sync(); err != nil {
 		return err
 	}
+	if err = d.tempFile.Close(); err != nil {
+		return err
+	}
+	d.outWriteCloser = nil
 
-	if d.keyReader != nil {
-		if err = d.keyReader.Close(); err != nil {
-			return err
-		}
+	if err = movePackage(d.tempFile.Name(), d.PackagePath); err != nil {
+		return err
+	}
+	d.tempFile = nil
+
+	// Make the move itself durable, where the platform allows it.
+	if dir, err := os.Open(filepath.Dir(d.PackagePath)); err == nil {
+		dir.Sync()
+		dir.Close()
 	}
 
 	return nil
 }
 
-func (d *DataPackage) encryptionKeyReader() (io.Reader, error) {
+// createTemp creates a new file in dir with a random name starting with prefix
+// and the permissions mode, subject to the umask, unlike ioutil.TempFile,
+// which always makes the file private.
+func createTemp(dir string, prefix string, mode os.FileMode) (*os.File, error) {
+	for i := 0; i < 10000; i++ {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10))
 
-	var err error
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, mode)
+		if os.IsExist(err) {
+			continue
+		}
+		return f, err
+	}
+
+	return nil, &os.PathError{Op: "createtemp", Path: filepath.Join(dir, prefix+"*"), Err: os.ErrExist}
+}
+
+// movePackage moves the package file at temp to path, failing if path exists.
+// The file is hard linked to path, which fails if path exists, and then
+// removed. On file systems without hard links it is renamed instead, which
+// replaces a package that another process creates at path in between the
+// check for it and the rename.
+func movePackage(temp string, path string) error {
+	err := os.Link(temp, path)
+	if err == nil {
+		// The package is in place, so a leftover temporary file is no reason
+		// to fail.
+		os.Remove(temp)
+		return nil
+	}
+	if !errors.Is(err, errors.ErrUnsupported) && !errors.Is(err, os.ErrPermission) {
+		return err
+	}
+
+	if _, err = os.Lstat(path); err == nil {
+		return &os.PathError{Op: "rename", Path: path, Err: os.ErrExist}
+	}
+
+	return os.Rename(temp, path)
+}
+
+// abortPack closes every open layer of the package writer, ignoring errors,
+// and removes the temporary package file. Output to STDOUT, which cannot be
+// removed, is cut off first, so that the layers write no trailers that would
+// make the partial package look complete.
+func (d *DataPackage) abortPack() {
+	if w, ok := d.outWriteCloser.(*cutWriter); ok {
+		w.cut = true
+	}
+
+	if d.archiveWriter != nil {
+		d.archiveWriter.Close()
+		d.archiveWriter = nil
+	}
+
+	if d.compWriteCloser != nil {
+		d.compWriteCloser.Close()
+		d.compWriteCloser = nil
+	}
+
+	if d.encWriteCloser != nil {
+		d.encWriteCloser.Close()
+		d.encWriteCloser = nil
+	}
+
+	if d.tempFile != nil {
+		d.tempFile.Close()
+		os.Remove(d.tempFile.Name())
+		d.tempFile = nil
+		d.outWriteCloser = nil
+	}
+}
+
+// errPackAborted is returned for writes to a package output that has been cut
+// off.
+var errPackAborted = errors.New("package aborted")
+
+// cutWriter writes to w until it is cut off, after which every write fails.
+type cutWriter struct {
+	w   io.WriteCloser
+	cut bool
+}
+
+func (c *cutWriter) Write(b []byte) (int, error) {
+	if c.cut {
+		return 0, errPackAborted
+	}
+	return c.w.Write(b)
+}
+
+func (c *cutWriter) Close() error {
+	return c.w.Close()
+}
+
+// hasRecipients returns true if any public key to encrypt to is given.
+func (d *DataPackage) hasRecipients() bool {
+	return d.KeyPath != "" || d.PublicKeyEmail != "" || len(d.RecipientKeyPaths) > 0 || len(d.RecipientEmails) > 0
+}
+
+// encryptionKeys returns the public keys to encrypt the package to: every key
+// in the file at KeyPath (or resolved for PublicKeyEmail) and in each of
+// RecipientKeyPaths and RecipientEmails.
+func (d *DataPackage) encryptionKeys() (openpgp.EntityList, error) {
+
+	var recipients openpgp.EntityList
+
+	keyPaths := d.RecipientKeyPaths
+	emails := d.RecipientEmails
 
 	if d.KeyPath != "" {
+		keyPaths = append([]string{d.KeyPath}, keyPaths...)
+	} else if d.PublicKeyEmail != "" {
+		emails = append([]string{d.PublicKeyEmail}, emails...)
+	} else if len(keyPaths) == 0 && len(emails) == 0 {
+		return nil, errors.New("Either KeyPath or PublicKeyEmail must be specified")
+	}
+
+	for _, keyPath := range keyPaths {
 
-		d.keyReader, err = os.Open(d.KeyPath)
+		entityList, err := readKeyRingFile(keyPath)
 		if err != nil {
-			return nil, fmt.Errorf("encryptionKeyReader: error opening d.keyPath: %v", err)
+			return nil, err
 		}
 
-		return io.Reader(d.keyReader), nil
-
-	} else if d.PublicKeyEmail != "" {
+		recipients = append(recipients, entityList...)
+	}
 
-		gpgQueryTemplate := "http://pool.sks-keyservers.net:11371/pks/lookup?search={{EMAIL}}&op=get&options=mr"
-		email := url.QueryEscape(d.PublicKeyEmail)
-		gpgQuery := strings.Replace(gpgQueryTemplate, "{{EMAIL}}", email, 1)
+	for _, email := range emails {
 
-		response, err := http.Get(gpgQuery)
+		entityList, err := d.resolveKey(email)
 		if err != nil {
-			return nil, fmt.Errorf("Error fetching public key from pool.sks-keyservers.net:11371: %v", err)
+			return nil, fmt.Errorf("error resolving public key for %s: %w", email, err)
 		}
-		d.keyReader = response.Body
-		return d.keyReader, nil
 
-	} else {
-		return nil, errors.New("Either KeyPath or PublicKeyEmail must be specified")
+		recipients = append(recipients, entityList...)
 	}
+
+	return recipients, nil
+}
+
+// packFile is a file found in the data directory to be packed.
+type packFile struct {
+	path    string // Path of the file.
+	relPath string // Path relative to the data directory.
+	size    int64
 }
 
-// makeFilePackFunc returns a filepath.WalkFunc that packs files in the basePath
-// directory using the passed writer.
-func (d *DataPackage) makeFilePackFunc(basePath string) filepath.WalkFunc {
+// makeFileListFunc returns a filepath.WalkFunc that lists the files in the
+// basePath directory that pass the filter in files.
+func (d *DataPackage) makeFileListFunc(basePath string, filter *fileFilter, files *[]packFile) filepath.WalkFunc {
 
 	return func(path string, fi os.FileInfo, inErr error) error {
 
 		var (
 			relPath string
-			r       *os.File
-			buf     []byte
 			err     error
 		)
 
@@ -125,14 +386,9 @@ func (d *DataPackage) makeFilePackFunc(basePath string) filepath.WalkFunc {
 			return err
 		}
 
-		// Skip directories.
-		if fi.IsDir() {
-			return nil
-		}
-
-		// Error if non-csv file found.
-		if filepath.Ext(path) != ".csv" {
-			return fmt.Errorf("non-csv file found: %s", path)
+		// Stop walking if the Pack has been cancelled.
+		if err = d.context().Err(); err != nil {
+			return err
 		}
 
 		// Get path relative to base of package directory.
@@ -140,119 +396,167 @@ func (d *DataPackage) makeFilePackFunc(basePath string) filepath.WalkFunc {
 			return err
 		}
 
-		// Write file header to writer, preparing for writing of new file.
-		if err = d.writeTarHeader(fi, relPath); err != nil {
-			return err
+		if relPath == "." {
+			return nil
 		}
 
-		// Open data file.
-		if r, err = os.Open(path); err != nil {
-			return err
+		// Skip excluded files and directories.
+		if filter.excluded(filepath.ToSlash(relPath), fi.IsDir()) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
 		}
 
-		defer r.Close()
+		// Skip directories.
+		if fi.IsDir() {
+			return nil
+		}
 
-		// Copy data file to writer.
-		log.Printf("writing '%s' to data package", fi.Name())
-
-		buf = make([]byte, 32*1024)
-
-		for {
-			nr, er := r.Read(buf)
-			if nr > 0 {
-				nw, ew := d.write(buf[0:nr])
-				if ew != nil {
-					err = ew
-					break
-				}
-				if nr != nw {
-					err = errors.New("short write")
-					break
-				}
-			}
-			if er == io.EOF {
-				break
-			}
-			if er != nil {
-				err = er
-				break
+		// Apply the unmatched file policy to files that are not included.
+		if !filter.matched(filepath.ToSlash(relPath)) {
+			switch filter.unmatched {
+			case UnmatchedSkip:
+				d.logger().Warn("skipping unmatched file", "file", filepath.ToSlash(relPath), "size", fi.Size(), "phase", "scan")
+				return nil
+			case UnmatchedError:
+				return fmt.Errorf("unmatched file found: %s", path)
 			}
 		}
 
-		return err
+		*files = append(*files, packFile{path: path, relPath: relPath, size: fi.Size()})
+
+		return nil
 
 	}
 
 }
 
-// Pack writes the data files at base path into a package.
+// Pack writes the data files at base path into a package, followed by a
+// manifest of their sizes and SHA-256 digests. The package file is written
+// under a temporary name and only moved to PackagePath, which must not exist,
+// once it is complete and synced to disk. An existing file at PackagePath is
+// never replaced, except on file systems without hard links, where one created
+// by another process just as Pack finishes may be. Which files are data files is
+// decided by Include, Exclude, Extensions, OnUnmatched and the .packignore
+// file in the directory.
 func (d *DataPackage) Pack(dataDirPath string) error {
+	return d.PackContext(context.Background(), dataDirPath)
+}
 
-	var (
-		err          error
-		filePackFunc filepath.WalkFunc
-	)
+// PackContext is like Pack, but stops once ctx is done, checking between files
+// and while copying them, in which case it closes the package and removes the
+// partial package file and returns the context's error. The context also
+// applies to public key lookups.
+func (d *DataPackage) PackContext(ctx context.Context, dataDirPath string) error {
 
-	// Open the first level of writer, keeping the API for writing and closing
-	// to it consistent regardless of the underlying implementation.
-	if d.PackagePath != "" {
-		if d.outWriteCloser, err = os.OpenFile(d.PackagePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644); err != nil {
-			return err
-		}
-	} else {
-		d.outWriteCloser = os.Stdout
+	d.ctx = ctx
+	defer func() { d.ctx = nil }()
+
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	// Open the encryption writer if desired
-	if d.gpgInUse() {
+	filter, err := d.newFileFilter(dataDirPath)
+	if err != nil {
+		return err
+	}
+
+	w, err := NewPackageWriter(d)
+	if err != nil {
+		return err
+	}
 
-		keyReader, err := d.encryptionKeyReader()
+	// Name the descriptor after the data directory rather than the package.
+	if d.descriptor != nil {
+		absPath, err := filepath.Abs(dataDirPath)
 		if err != nil {
+			d.abortPack()
 			return err
 		}
-		if d.encWriteCloser, err = encrypt(d.outWriteCloser, keyReader); err != nil {
-			return err
-		}
-
+		d.descriptor.Name = descriptorName(filepath.Base(absPath))
 	}
 
-	// BUG(aaron0browne): The .tar.gz format compressed packages output by
-	// DataPackage.Pack cannot be read by standard tar and gzip tools. The
-	// authors believe this is due to the underlying library implementations.
-	if d.encWriteCloser != nil {
-		d.gzipWriteCloser = gzip.NewWriter(d.encWriteCloser)
-		d.tarWriteCloser = tar.NewWriter(d.gzipWriteCloser)
-	} else {
-		d.gzipWriteCloser = gzip.NewWriter(d.outWriteCloser)
-		d.tarWriteCloser = tar.NewWriter(d.gzipWriteCloser)
+	// List the files first, so that their total size is known for Progress.
+	var files []packFile
+	if err := filepath.Walk(dataDirPath, d.makeFileListFunc(dataDirPath, filter, &files)); err != nil {
+		d.abortPack()
+		return err
 	}
 
-	// Make a filepath.WalkFunc to pack files into the package.
-	filePackFunc = d.makeFilePackFunc(dataDirPath)
+	if d.Reproducible {
+		sort.Slice(files, func(i, j int) bool {
+			return filepath.ToSlash(files[i].relPath) < filepath.ToSlash(files[j].relPath)
+		})
+	}
 
-	// Write the files into a package.
-	if err := filepath.Walk(dataDirPath, filePackFunc); err != nil {
-		return err
+	var total int64
+	for _, f := range files {
+		total += f.size
 	}
+	d.progress.event.TotalBytes = total
 
-	d.finishPack() // flush and close
+	// Write the files into a package, abandoning it on failure.
+	for _, f := range files {
+		// Stop between files if the Pack has been cancelled.
+		if err := ctx.Err(); err != nil {
+			d.abortPack()
+			return err
+		}
 
-	return nil
+		// Copy data file to writer.
+		d.logger().Info("packing file", "file", filepath.ToSlash(f.relPath), "size", f.size, "phase", "pack")
+
+		if err := w.addFile(f.path, f.relPath); err != nil {
+			d.abortPack()
+			return err
+		}
+	}
+
+	// Flush and close, which abandons the package on failure.
+	return w.Close()
 }
 
-// encrypt takes a writer to encrypt data onto and a reader containing the
-// ASCII-armored public key to encrypt with and returns a WriteCloser to write
-// onto and close. It assumes there is only one OpenPGP entity involved.
-func encrypt(plainWriter io.Writer, keyReader io.Reader) (io.WriteCloser, error) {
+// signingEntity reads the private key at SigningKeyPath and unlocks it with
+// the key passphrase. It returns nil if no signing key is given.
+func (d *DataPackage) signingEntity() (*openpgp.Entity, error) {
 
-	var (
-		entityList openpgp.EntityList
-		err        error
-	)
+	if d.SigningKeyPath == "" {
+		return nil, nil
+	}
+
+	entityList, err := readKeyRingFile(d.SigningKeyPath)
+	if err != nil {
+		return nil, err
+	}
 
-	if entityList, err = openpgp.ReadArmoredKeyRing(keyReader); err != nil {
-		return nil, fmt.Errorf("Encrypt: error calling ReadArmoredKeyRing: %v", err)
+	passphrase, err := d.passphrase()
+	if err != nil {
+		return nil, err
 	}
 
-	return openpgp.Encrypt(plainWriter, entityList, nil, nil, nil)
+	for _, entity := range entityList {
+		if entity.PrivateKey == nil {
+			continue
+		}
+		if err = unlockEntity(entity, passphrase); err != nil {
+			return nil, fmt.Errorf("error unlocking signing key: %v", err)
+		}
+		return entity, nil
+	}
+
+	return nil, fmt.Errorf("no private key found in '%s'", d.SigningKeyPath)
+}
+
+// encrypt takes a writer to encrypt data onto, the public keys of every
+// recipient and an optional unlocked private key to sign with, and returns a
+// WriteCloser to write onto and close. Any recipient can decrypt the result.
+func encrypt(plainWriter io.Writer, recipients openpgp.EntityList, signer *openpgp.Entity) (io.WriteCloser, error) {
+	return openpgp.Encrypt(plainWriter, recipients, signer, nil, nil)
+}
+
+// sign takes a writer to write a signed message onto and an unlocked private
+// key to sign with, and returns a WriteCloser to write onto and close.
+func sign(plainWriter io.Writer, signer *openpgp.Entity) (io.WriteCloser, error) {
+	return openpgp.Sign(plainWriter, signer, nil, nil)
 }
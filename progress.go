@@ -0,0 +1,59 @@
+package datapackage
+
+// ProgressEvent reports how far a Pack or Unpack has got. Pack knows the total
+// number of bytes to pack from walking the data directory first. Unpack knows
+// it only for ZIP packages, whose index lists every file. Tar packages give the
+// size of each file in its header, just before its contents, so on Unpack of a
+// tar package FileSize is known for every file but TotalBytes is -1, as
+// finding it would take reading the whole package twice.
+type ProgressEvent struct {
+	Op         string // "pack" or "unpack".
+	Path       string // Slash-separated package path of the current file.
+	FileBytes  int64  // Bytes of the current file done so far.
+	FileSize   int64  // Size of the current file in bytes, from its header on Unpack.
+	Bytes      int64  // Bytes of all files done so far.
+	TotalBytes int64  // Bytes of all files together, or -1 if unknown.
+}
+
+// progress tracks the bytes done by a Pack or Unpack and reports them to the
+// Progress function of the DataPackage, if any.
+type progress struct {
+	fn    func(ProgressEvent)
+	event ProgressEvent
+}
+
+// newProgress returns a progress for op reporting to fn, which may be nil.
+func newProgress(fn func(ProgressEvent), op string, total int64) *progress {
+	return &progress{fn: fn, event: ProgressEvent{Op: op, TotalBytes: total}}
+}
+
+// start reports the start of the file with the given package path and size.
+func (p *progress) start(path string, size int64) {
+	p.event.Path = path
+	p.event.FileBytes = 0
+	p.event.FileSize = size
+
+	if p.fn != nil {
+		p.fn(p.event)
+	}
+}
+
+// add reports n more bytes done of the current file.
+func (p *progress) add(n int) {
+	if n == 0 {
+		return
+	}
+
+	p.event.FileBytes += int64(n)
+	p.event.Bytes += int64(n)
+
+	if p.fn != nil {
+		p.fn(p.event)
+	}
+}
+
+// sizedArchive is implemented by archive readers that know the total size of
+// the files in the archive before reading them.
+type sizedArchive interface {
+	totalSize() int64
+}
@@ -0,0 +1,234 @@
+package datapackage
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Entry describes a file in a package.
+type Entry struct {
+	Name     string      // Slash-separated path as stored in the package.
+	Size     int64       // Size of the file in bytes.
+	Mode     os.FileMode // Permission and type bits.
+	ModTime  time.Time   // Modification time.
+	Linkname string      // Target of a link entry.
+
+	header *tar.Header
+}
+
+// PackageReader reads the files in a package one at a time without
+// extracting them, through the same decryption and decompression layers as
+// Unpack.
+//
+// Each file is checked against the manifest as it is read, whether in full or
+// skipped by Next, and once the last file has been read Next returns io.EOF
+// or, if the package fails verification, a *ManifestError or *SignatureError.
+// Entry names are returned as stored in the package and are not checked for
+// safety as Unpack does. The Limits of the DataPackage apply.
+//
+// A PackageReader keeps its state in the DataPackage it is created for, so
+// only one may be in use per DataPackage at a time.
+type PackageReader struct {
+	d        *DataPackage
+	lim      *limiter
+	hdr      *tar.Header
+	hash     hash.Hash
+	size     int64
+	unpacked map[string]ManifestFile
+}
+
+// NewPackageReader opens the package at d.PackagePath (or STDIN) for reading.
+func NewPackageReader(d *DataPackage) (*PackageReader, error) {
+	if err := d.openReader(); err != nil {
+		d.finishUnpack()
+		return nil, err
+	}
+
+	d.manifest = nil
+
+	r := &PackageReader{
+		d:        d,
+		lim:      &limiter{limits: d.Limits, in: d.inCounter},
+		unpacked: make(map[string]ManifestFile),
+	}
+
+	return r, nil
+}
+
+// Next advances to the next file in the package, skipping the rest of the
+// current one, and returns its description. The manifest is consumed rather
+// than returned.
+func (r *PackageReader) Next() (*Entry, error) {
+	if err := r.finishEntry(); err != nil {
+		return nil, err
+	}
+
+	if err := r.d.context().Err(); err != nil {
+		return nil, err
+	}
+
+	for {
+		hdr, err := r.d.next()
+		if err == io.EOF {
+			// The package has been read to the end, so its signature and
+			// manifest can be checked.
+			if err = r.d.verifySignature(); err != nil {
+				return nil, err
+			}
+			if r.d.manifest != nil {
+				if err = r.d.manifest.verify(r.unpacked); err != nil {
+					return nil, err
+				}
+			}
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Read the manifest rather than returning it.
+		if hdr.Name == ManifestName {
+			if r.d.manifest, err = r.d.readManifest(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if err = r.lim.entry(hdr.Name, hdr.Size); err != nil {
+			return nil, err
+		}
+
+		r.hdr = hdr
+		r.hash = sha256.New()
+		r.size = 0
+
+		return &Entry{
+			Name:     hdr.Name,
+			Size:     hdr.Size,
+			Mode:     hdr.FileInfo().Mode(),
+			ModTime:  hdr.ModTime,
+			Linkname: hdr.Linkname,
+			header:   hdr,
+		}, nil
+	}
+}
+
+// Read reads from the current file in the package.
+func (r *PackageReader) Read(b []byte) (int, error) {
+	if r.hdr == nil {
+		return 0, io.EOF
+	}
+
+	if err := r.d.context().Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := r.d.read(b)
+
+	if lerr := r.lim.write(r.hdr.Name, r.size, n); lerr != nil {
+		return 0, lerr
+	}
+
+	r.hash.Write(b[:n])
+	r.size += int64(n)
+
+	return n, err
+}
+
+// finishEntry reads the rest of the current file, if any, and records its
+// size and digest for checking against the manifest.
+func (r *PackageReader) finishEntry() error {
+	if r.hdr == nil {
+		return nil
+	}
+
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return err
+	}
+
+	switch r.hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		r.unpacked[r.hdr.Name] = ManifestFile{
+			Path:   r.hdr.Name,
+			Size:   r.size,
+			SHA256: hex.EncodeToString(r.hash.Sum(nil)),
+		}
+	}
+
+	r.hdr = nil
+
+	return nil
+}
+
+// Manifest returns the package manifest, or nil if it has not been read yet or
+// the package has none. Pack writes the manifest last, so it is available once
+// Next has returned io.EOF.
+func (r *PackageReader) Manifest() *Manifest {
+	return r.d.manifest
+}
+
+// Close closes the package. It may be called more than once.
+func (r *PackageReader) Close() error {
+	return r.d.finishUnpack()
+}
+
+// EntryInfo describes a file listed by List.
+type EntryInfo struct {
+	Path    string      // Slash-separated path as stored in the package.
+	Size    int64       // Size of the file in bytes.
+	Mode    os.FileMode // Permission and type bits.
+	ModTime time.Time   // Modification time.
+	SHA256  string      // Hex-encoded SHA-256 digest from the manifest, if the package has one.
+}
+
+// List reads the package to the end, through the same decryption,
+// decompression and verification as Unpack, and describes every file in it
+// without extracting anything. The manifest is not listed. If the package
+// fails verification, the files read so far are returned along with the
+// error.
+func (d *DataPackage) List() ([]EntryInfo, error) {
+	r, err := NewPackageReader(d)
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	var entries []EntryInfo
+
+	for {
+		entry, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return entries, err
+		}
+
+		entries = append(entries, EntryInfo{
+			Path:    entry.Name,
+			Size:    entry.Size,
+			Mode:    entry.Mode,
+			ModTime: entry.ModTime,
+		})
+	}
+
+	// Pack writes the manifest last, so the checksums are only known now.
+	if m := r.Manifest(); m != nil {
+		sums := make(map[string]string, len(m.Files))
+		for _, f := range m.Files {
+			sums[f.Path] = f.SHA256
+		}
+		for i := range entries {
+			entries[i].SHA256 = sums[entries[i].Path]
+		}
+	}
+
+	return entries, nil
+}
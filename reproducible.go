@@ -0,0 +1,59 @@
+package datapackage
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// SourceDateEpochEnv is the environment variable that, for Reproducible
+// packages, holds the time in seconds since the Unix epoch that modification
+// times are clamped to, following https://reproducible-builds.org/specs/source-date-epoch/.
+const SourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+
+// sourceDateEpoch returns the time in SOURCE_DATE_EPOCH, or the zero time if
+// it is not set.
+func sourceDateEpoch() (time.Time, error) {
+	value := os.Getenv(SourceDateEpochEnv)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	sec, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || sec < 0 {
+		return time.Time{}, fmt.Errorf("invalid %s '%s'", SourceDateEpochEnv, value)
+	}
+
+	return time.Unix(sec, 0).UTC(), nil
+}
+
+// normalizeHeader makes hdr independent of the system, user and time the
+// package is written on: the owner is root, permissions are 0644 (or 0755
+// if the file is executable by its owner) and the modification time is that
+// in SOURCE_DATE_EPOCH if it is earlier, or the Unix epoch if that is not
+// set.
+func (d *DataPackage) normalizeHeader(hdr *tar.Header) {
+	hdr.Uid, hdr.Gid = 0, 0
+	hdr.Uname, hdr.Gname = "", ""
+
+	if hdr.Mode&0100 != 0 {
+		hdr.Mode = 0755
+	} else {
+		hdr.Mode = 0644
+	}
+
+	switch {
+	case d.sourceDate.IsZero():
+		hdr.ModTime = time.Unix(0, 0).UTC()
+	case hdr.ModTime.After(d.sourceDate):
+		hdr.ModTime = d.sourceDate
+	default:
+		hdr.ModTime = hdr.ModTime.Truncate(time.Second).UTC()
+	}
+
+	hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+	hdr.PAXRecords = nil
+	hdr.Format = tar.FormatUnknown
+}
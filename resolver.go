@@ -0,0 +1,250 @@
+package datapackage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// DefaultKeyServer is the HKPS keyserver that public keys are looked up on
+// when DataPackage.KeyResolver is nil.
+const DefaultKeyServer = "hkps://keys.openpgp.org"
+
+// maxKeyResponse is the largest keyserver or Web Key Directory response read,
+// far more than any set of public keys for one address needs.
+const maxKeyResponse = 4 << 20
+
+// ErrKeyNotFound is wrapped by the errors a KeyResolver returns when there is
+// no public key for the email address.
+var ErrKeyNotFound = errors.New("no public key found")
+
+// KeyResolver looks up the public keys for an email address, which Pack uses
+// for PublicKeyEmail and RecipientEmails. Implementations return an error
+// wrapping ErrKeyNotFound rather than an empty EntityList.
+type KeyResolver interface {
+	Resolve(ctx context.Context, email string) (openpgp.EntityList, error)
+}
+
+// HKPResolver looks up public keys on a keyserver using the HTTP Keyserver
+// Protocol.
+//
+// BaseURL is the keyserver address. The hkp:// and hkps:// schemes map to HTTP
+// on port 11371 and HTTPS, respectively, and http:// and https:// URLs are
+// used as given.
+//
+// Client is used for requests, or http.DefaultClient if it is nil.
+type HKPResolver struct {
+	BaseURL string       // Keyserver address, e.g. "hkps://keys.openpgp.org".
+	Client  *http.Client // HTTP client, or nil for http.DefaultClient.
+}
+
+// Resolve fetches the keys for email from the keyserver.
+func (r *HKPResolver) Resolve(ctx context.Context, email string) (openpgp.EntityList, error) {
+	base, err := url.Parse(r.BaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("hkp: invalid keyserver URL '%s': %v", r.BaseURL, err)
+	}
+
+	switch base.Scheme {
+	case "hkp":
+		base.Scheme = "http"
+		if base.Port() == "" {
+			base.Host += ":11371"
+		}
+	case "hkps":
+		base.Scheme = "https"
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("hkp: unsupported keyserver scheme '%s'", base.Scheme)
+	}
+
+	base.Path = strings.TrimSuffix(base.Path, "/") + "/pks/lookup"
+	base.RawQuery = url.Values{"op": {"get"}, "options": {"mr"}, "search": {email}}.Encode()
+
+	b, err := httpGet(ctx, r.Client, base.String())
+	if err != nil {
+		return nil, fmt.Errorf("hkp: %w", err)
+	}
+
+	entityList, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("hkp: error reading keys for %s: %v", email, err)
+	}
+
+	return matchEmail(entityList, email)
+}
+
+// WKDResolver looks up public keys in the Web Key Directory of the email
+// domain, trying the advanced method (openpgpkey.<domain>) before the direct
+// method.
+//
+// Client is used for requests, or http.DefaultClient if it is nil.
+type WKDResolver struct {
+	Client *http.Client // HTTP client, or nil for http.DefaultClient.
+}
+
+// Resolve fetches the keys for email from the Web Key Directory.
+func (r *WKDResolver) Resolve(ctx context.Context, email string) (openpgp.EntityList, error) {
+	at := strings.LastIndex(email, "@")
+	if at <= 0 || at == len(email)-1 {
+		return nil, fmt.Errorf("wkd: invalid email address '%s'", email)
+	}
+
+	local := email[:at]
+	domain := strings.ToLower(email[at+1:])
+	hash := sha1.Sum([]byte(strings.ToLower(local)))
+	query := "?l=" + url.QueryEscape(local)
+	hu := zbase32(hash[:])
+
+	urls := []string{
+		"https://openpgpkey." + domain + "/.well-known/openpgpkey/" + domain + "/hu/" + hu + query,
+		"https://" + domain + "/.well-known/openpgpkey/hu/" + hu + query,
+	}
+
+	var (
+		b   []byte
+		err error
+	)
+
+	for _, u := range urls {
+		if b, err = httpGet(ctx, r.Client, u); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("wkd: %w", err)
+	}
+
+	entityList, err := openpgp.ReadKeyRing(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("wkd: error reading keys for %s: %v", email, err)
+	}
+
+	return matchEmail(entityList, email)
+}
+
+// DirResolver looks up public keys in a local directory of ASCII-armored or
+// binary keyring files ending in .asc, .gpg, .key or .pgp.
+type DirResolver struct {
+	Dir string // Path to the directory of keyring files.
+}
+
+// Resolve returns the keys in the directory with a user ID for email.
+func (r *DirResolver) Resolve(ctx context.Context, email string) (openpgp.EntityList, error) {
+	entityList, err := readKeyRingPath(r.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("dir: %v", err)
+	}
+
+	return matchEmail(entityList, email)
+}
+
+// resolveKey looks up the public keys for email with KeyResolver, or on the
+// DefaultKeyServer if it is nil, within the context of the current Pack.
+func (d *DataPackage) resolveKey(email string) (openpgp.EntityList, error) {
+	resolver := d.KeyResolver
+	if resolver == nil {
+		resolver = &HKPResolver{BaseURL: DefaultKeyServer}
+	}
+
+	return resolver.Resolve(d.context(), email)
+}
+
+// httpGet fetches u, returning an error wrapping ErrKeyNotFound for a 404 or
+// an empty response, an error naming the status for any other non-200
+// response and an error for a response larger than maxKeyResponse.
+func httpGet(ctx context.Context, client *http.Client, u string) ([]byte, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("%w at %s", ErrKeyNotFound, u)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxKeyResponse+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxKeyResponse {
+		return nil, fmt.Errorf("%s returned more than %d bytes", u, maxKeyResponse)
+	}
+
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil, fmt.Errorf("%w at %s", ErrKeyNotFound, u)
+	}
+
+	return b, nil
+}
+
+// matchEmail returns the entities with a user ID for email (compared
+// case-insensitively), or an error wrapping ErrKeyNotFound if there are none.
+func matchEmail(entityList openpgp.EntityList, email string) (openpgp.EntityList, error) {
+	var matched openpgp.EntityList
+
+	for _, entity := range entityList {
+		for _, ident := range entity.Identities {
+			if ident.UserId != nil && strings.EqualFold(ident.UserId.Email, email) {
+				matched = append(matched, entity)
+				break
+			}
+		}
+	}
+
+	if len(matched) == 0 {
+		return nil, fmt.Errorf("%w for %s", ErrKeyNotFound, email)
+	}
+
+	return matched, nil
+}
+
+// zbase32 encodes b with the z-base-32 alphabet used by Web Key Directory
+// hashes.
+func zbase32(b []byte) string {
+	const alphabet = "ybndrfg8ejkmcpqxot1uwisza345h769"
+
+	var (
+		out   []byte
+		acc   uint
+		nbits uint
+	)
+
+	for _, c := range b {
+		acc = acc<<8 | uint(c)
+		nbits += 8
+		for nbits >= 5 {
+			nbits -= 5
+			out = append(out, alphabet[(acc>>nbits)&31])
+		}
+	}
+
+	if nbits > 0 {
+		out = append(out, alphabet[(acc<<(5-nbits))&31])
+	}
+
+	return string(out)
+}
@@ -0,0 +1,172 @@
+package datapackage_test
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/infomodels/datapackage"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// newTestKeyServer returns an HKP keyserver stand-in that serves the test
+// public key for its email, an empty, failed or oversized response for the
+// empty, broken and huge addresses and 404 for any other search.
+func newTestKeyServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		if r.URL.Path != "/pks/lookup" || q.Get("op") != "get" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		switch q.Get("search") {
+		case testKeyEmail:
+			w.Write([]byte(testPublicKey))
+		case "empty@test.er":
+		case "broken@test.er":
+			http.Error(w, "keyserver broken", http.StatusInternalServerError)
+		case "huge@test.er":
+			for i := 0; i < 1024; i++ {
+				if _, err := w.Write(make([]byte, 64<<10)); err != nil {
+					return
+				}
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestHKPResolver(t *testing.T) {
+	keyServer := newTestKeyServer(t)
+	defer keyServer.Close()
+
+	r := &datapackage.HKPResolver{BaseURL: keyServer.URL}
+
+	entityList, err := r.Resolve(context.Background(), testKeyEmail)
+	if err != nil {
+		t.Fatalf("packer tests: error resolving key: %v", err)
+	}
+	if len(entityList) != 1 {
+		t.Fatalf("packer tests: resolved %d keys, expected 1", len(entityList))
+	}
+
+	for _, email := range []string{"missing@test.er", "empty@test.er"} {
+		if _, err = r.Resolve(context.Background(), email); !errors.Is(err, datapackage.ErrKeyNotFound) {
+			t.Fatalf("packer tests: %s: expected ErrKeyNotFound, got %v", email, err)
+		}
+	}
+
+	if _, err = r.Resolve(context.Background(), "broken@test.er"); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Fatalf("packer tests: expected error naming status 500, got %v", err)
+	}
+
+	if _, err = r.Resolve(context.Background(), "huge@test.er"); err == nil || !strings.Contains(err.Error(), "more than") {
+		t.Fatalf("packer tests: expected error for an oversized response, got %v", err)
+	}
+
+	// The hkp:// scheme maps onto HTTP.
+	u, _ := url.Parse(keyServer.URL)
+	r = &datapackage.HKPResolver{BaseURL: "hkp://" + u.Host}
+
+	if _, err = r.Resolve(context.Background(), testKeyEmail); err != nil {
+		t.Fatalf("packer tests: error resolving key over hkp://: %v", err)
+	}
+}
+
+// redirectTransport sends every request to a single test server.
+type redirectTransport struct {
+	host      string
+	transport http.RoundTripper
+	hosts     []string
+}
+
+func (rt *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.hosts = append(rt.hosts, req.URL.Host)
+	req = req.Clone(req.Context())
+	req.URL.Host = rt.host
+	return rt.transport.RoundTrip(req)
+}
+
+func TestWKDResolver(t *testing.T) {
+	block, err := armor.Decode(strings.NewReader(testPublicKey))
+	if err != nil {
+		t.Fatalf("packer tests: error decoding public key: %v", err)
+	}
+	binaryKey, err := ioutil.ReadAll(block.Body)
+	if err != nil {
+		t.Fatalf("packer tests: error decoding public key: %v", err)
+	}
+
+	// "testy" hashes to this z-base-32 encoded SHA-1. Only the direct method is
+	// served, so the advanced method must fall back to it.
+	const path = "/.well-known/openpgpkey/hu/9jq44nhjuxxbg6p7ywpsfpn77r38ifb3"
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path || r.URL.Query().Get("l") != "testy" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(binaryKey)
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	transport := &redirectTransport{
+		host:      u.Host,
+		transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+
+	r := &datapackage.WKDResolver{Client: &http.Client{Transport: transport}}
+
+	entityList, err := r.Resolve(context.Background(), testKeyEmail)
+	if err != nil {
+		t.Fatalf("packer tests: error resolving key: %v", err)
+	}
+	if len(entityList) != 1 {
+		t.Fatalf("packer tests: resolved %d keys, expected 1", len(entityList))
+	}
+	if len(transport.hosts) != 2 || transport.hosts[0] != "openpgpkey.test.er" || transport.hosts[1] != "test.er" {
+		t.Fatalf("packer tests: unexpected WKD hosts %v", transport.hosts)
+	}
+
+	if _, err = r.Resolve(context.Background(), "nobody@test.er"); !errors.Is(err, datapackage.ErrKeyNotFound) {
+		t.Fatalf("packer tests: expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestDirResolver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testkeydir")
+	if err != nil {
+		t.Fatalf("packer tests: can't create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+
+	if err = ioutil.WriteFile(filepath.Join(dir, "testy.asc"), []byte(testPublicKey), 0644); err != nil {
+		t.Fatalf("packer tests: error writing key: %v", err)
+	}
+
+	r := &datapackage.DirResolver{Dir: dir}
+
+	entityList, err := r.Resolve(context.Background(), strings.ToUpper(testKeyEmail))
+	if err != nil {
+		t.Fatalf("packer tests: error resolving key: %v", err)
+	}
+	if len(entityList) != 1 {
+		t.Fatalf("packer tests: resolved %d keys, expected 1", len(entityList))
+	}
+
+	if _, err = r.Resolve(context.Background(), "nobody@test.er"); !errors.Is(err, datapackage.ErrKeyNotFound) {
+		t.Fatalf("packer tests: expected ErrKeyNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package datapackage
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrPathTraversal is wrapped by an *UnsafeEntryError for an entry whose path
+// (or link target) is absolute, leaves the target directory or passes through
+// a symbolic link.
+var ErrPathTraversal = errors.New("path leaves the target directory")
+
+// ErrLinkEntry is wrapped by an *UnsafeEntryError for a symbolic or hard link
+// entry when DataPackage.AllowLinks is not set.
+var ErrLinkEntry = errors.New("entry is a link")
+
+// ErrSpecialEntry is wrapped by an *UnsafeEntryError for a device or FIFO
+// entry when DataPackage.AllowDevices is not set, or an entry of a type Unpack
+// does not support.
+var ErrSpecialEntry = errors.New("entry is a device or other special file")
+
+// UnsafeEntryError reports a package entry that Unpack refuses to extract.
+type UnsafeEntryError struct {
+	Name string // Name of the entry, as stored in the package.
+	Err  error  // ErrPathTraversal, ErrLinkEntry or ErrSpecialEntry.
+}
+
+func (e *UnsafeEntryError) Error() string {
+	return fmt.Sprintf("unsafe entry '%s': %v", e.Name, e.Err)
+}
+
+func (e *UnsafeEntryError) Unwrap() error {
+	return e.Err
+}
+
+// entryPath returns the path under root that the entry hdr extracts to, or an
+// *UnsafeEntryError if the entry must not be extracted: its path or link
+// target would leave root, its parent directories include a symbolic link, or
+// it is a link or special file that is not allowed.
+func (d *DataPackage) entryPath(root string, hdr *tar.Header) (string, error) {
+	unsafe := func(err error) (string, error) {
+		return "", &UnsafeEntryError{Name: hdr.Name, Err: err}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeDir:
+	case tar.TypeSymlink, tar.TypeLink:
+		if !d.AllowLinks {
+			return unsafe(ErrLinkEntry)
+		}
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if !d.AllowDevices {
+			return unsafe(ErrSpecialEntry)
+		}
+	default:
+		return unsafe(ErrSpecialEntry)
+	}
+
+	rel, ok := localPath(hdr.Name)
+	if !ok {
+		return unsafe(ErrPathTraversal)
+	}
+
+	// Link targets must stay inside the target directory: symbolic links may
+	// only point down their own directory, so that no chain of them can lead
+	// out, and hard links name a path relative to the package root.
+	switch hdr.Typeflag {
+	case tar.TypeSymlink:
+		if _, ok = localPath(hdr.Linkname); !ok {
+			return unsafe(ErrPathTraversal)
+		}
+	case tar.TypeLink:
+		target, ok := localPath(hdr.Linkname)
+		if !ok {
+			return unsafe(ErrPathTraversal)
+		}
+		via, err := throughSymlink(root, target)
+		if err != nil {
+			return "", err
+		}
+		if via {
+			return unsafe(ErrPathTraversal)
+		}
+	}
+
+	// Refuse to write through a symbolic link, which an earlier entry (or
+	// anything else) may have put in the target directory.
+	via, err := throughSymlink(root, rel)
+	if err != nil {
+		return "", err
+	}
+	if via {
+		return unsafe(ErrPathTraversal)
+	}
+
+	return filepath.Join(root, rel), nil
+}
+
+// localPath cleans the slash-separated path name and returns it in the local
+// form, or false if it is absolute or leaves its root.
+func localPath(name string) (string, bool) {
+	if name == "" || strings.HasPrefix(name, "/") || strings.HasPrefix(name, `\`) {
+		return "", false
+	}
+
+	rel := filepath.Clean(filepath.FromSlash(name))
+
+	if filepath.IsAbs(rel) || filepath.VolumeName(rel) != "" {
+		return "", false
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+
+	return rel, true
+}
+
+// throughSymlink reports whether any existing parent directory of the path rel
+// under root is a symbolic link.
+func throughSymlink(root, rel string) (bool, error) {
+	dir := root
+
+	for _, elem := range strings.Split(filepath.Dir(rel), string(filepath.Separator)) {
+		if elem == "." {
+			break
+		}
+		dir = filepath.Join(dir, elem)
+
+		fi, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,412 @@
+package datapackage
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// staging is a hidden directory next to the target directory of an Unpack, or
+// inside it if it exists but its parent is not writable, which the package is
+// extracted into and then moved into place from once it has been read and
+// verified in full, so that a failed Unpack leaves the target directory as it
+// was.
+//
+// The package is extracted into the data subdirectory. Files it replaces in
+// the target directory are moved into the replaced subdirectory, to be moved
+// back if the Unpack fails. Directories are created writable by the owner only
+// and given their permissions once everything has been moved into them, so
+// that read-only ones can be filled without privileges.
+type staging struct {
+	target   string                 // Target directory of the Unpack.
+	dir      string                 // Staging directory.
+	inside   bool                   // Whether the staging directory is in the target.
+	dirMode  os.FileMode            // Permissions of directories created without an entry.
+	owner    bool                   // Whether to restore the owner of directories.
+	entries  []stagedEntry          // Entries extracted, in package order.
+	created  []string               // Directories created in or above the target.
+	modes    map[string]os.FileMode // Permissions of the directories created.
+	moved    []movedEntry           // Entries moved into the target directory.
+	replaced int                    // Number of files moved out of the target directory.
+}
+
+// stagedEntry is an entry extracted into the staging directory.
+type stagedEntry struct {
+	name    string      // Name of the entry, as stored in the package.
+	rel     string      // Path relative to the data directory.
+	isDir   bool        // Whether the entry is a directory.
+	mode    os.FileMode // Permissions of a directory entry.
+	modTime time.Time   // Modification time of the entry.
+	uid     int         // Owner of the entry.
+	gid     int         // Group of the entry.
+}
+
+// movedEntry records an entry moved into the target directory, and the file
+// it replaced there, if any.
+type movedEntry struct {
+	path   string // Path of the entry in the target directory.
+	backup string // Path the replaced file was moved to, or "".
+}
+
+// newStaging creates a staging directory for target next to it, with the
+// parent directories as needed, so that no partial file ever shows in target.
+// If target exists, the entries are moved into it one by one. If its parent is
+// not writable, or on another file system, which the entries could not be
+// moved from, the staging directory is created inside it instead. Otherwise
+// the staging directory is renamed into place as a whole. Directories created
+// without an entry get the permissions dirMode.
+func newStaging(target string, dirMode os.FileMode) (*staging, error) {
+	s := &staging{target: target, dirMode: dirMode, modes: make(map[string]os.FileMode)}
+
+	parent, prefix := filepath.Dir(target), "."+filepath.Base(target)+".unpack-"
+
+	var err error
+
+	if fi, serr := os.Stat(target); serr == nil && fi.IsDir() {
+		if parent != target {
+			if s.dir, err = ioutil.TempDir(parent, prefix); err == nil && !sameDevice(s.dir, target) {
+				os.Remove(s.dir)
+				s.dir = ""
+			}
+		}
+		if s.dir == "" {
+			if s.dir, err = ioutil.TempDir(target, ".unpack-"); err != nil {
+				return nil, err
+			}
+			s.inside = true
+		}
+	} else {
+		if err = s.mkdirAll(parent); err != nil {
+			s.rollback()
+			return nil, err
+		}
+		if s.dir, err = ioutil.TempDir(parent, prefix); err != nil {
+			s.rollback()
+			return nil, err
+		}
+	}
+
+	if err = os.Mkdir(s.dataDir(), 0700); err != nil {
+		s.rollback()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// dataDir returns the directory the package is extracted into.
+func (s *staging) dataDir() string {
+	return filepath.Join(s.dir, "data")
+}
+
+// add records the entry hdr extracted to the path rel under the data
+// directory, which is given the permissions mode if it is a directory.
+func (s *staging) add(rel string, hdr *tar.Header, mode os.FileMode) {
+	s.entries = append(s.entries, stagedEntry{
+		name:    hdr.Name,
+		rel:     rel,
+		isDir:   hdr.Typeflag == tar.TypeDir,
+		mode:    mode,
+		modTime: hdr.ModTime,
+		uid:     hdr.Uid,
+		gid:     hdr.Gid,
+	})
+}
+
+// commit moves the extracted entries into the target directory, applying the
+// conflict policy to those whose paths exist there, and records the outcome
+// in report. If the target directory does not exist, the data directory is
+// moved into place as a whole. Otherwise every entry is checked before any is
+// moved, and if an entry cannot be moved, those moved already are moved back.
+// The directories created are given their permissions last, deepest first.
+func (s *staging) commit(policy ConflictPolicy, report *UnpackReport) error {
+	if _, err := os.Lstat(s.target); os.IsNotExist(err) {
+		if err = os.Rename(s.dataDir(), s.target); err != nil {
+			return err
+		}
+		s.created = append(s.created, s.target)
+
+		modes := make(map[string]os.FileMode)
+		for _, e := range s.entries {
+			if e.isDir {
+				modes[e.rel] = e.mode
+			} else {
+				report.Created = append(report.Created, e.name)
+			}
+		}
+
+		err = filepath.Walk(s.target, func(path string, fi os.FileInfo, err error) error {
+			if err != nil || !fi.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(s.target, path)
+			if err != nil {
+				return err
+			}
+			mode, ok := modes[rel]
+			if !ok {
+				mode = s.dirMode
+			}
+			s.modes[path] = mode
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return s.setDirModes()
+	}
+
+	type move struct {
+		stagedEntry
+		path    string // Path to move the entry to.
+		replace bool   // Whether a file at path is replaced.
+	}
+
+	var (
+		moves     []move
+		conflicts []string
+		taken     = make(map[string]bool)
+	)
+
+	// Check every entry against the target directory first.
+	for _, e := range s.entries {
+		via, err := throughSymlink(s.target, e.rel)
+		if err != nil {
+			return err
+		}
+		if via {
+			return &UnsafeEntryError{Name: e.name, Err: ErrPathTraversal}
+		}
+
+		m := move{stagedEntry: e, path: filepath.Join(s.target, e.rel)}
+
+		existing, err := os.Lstat(m.path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if e.isDir {
+			switch {
+			case existing == nil:
+			case !existing.IsDir() && policy == ConflictFail:
+				conflicts = append(conflicts, e.name)
+			case !existing.IsDir():
+				return fmt.Errorf("cannot replace file '%s' with a directory", m.path)
+			}
+			moves = append(moves, m)
+			continue
+		}
+
+		if existing == nil && !taken[m.path] {
+			report.Created = append(report.Created, e.name)
+		} else {
+			if existing != nil && existing.IsDir() {
+				return fmt.Errorf("cannot replace directory '%s' with a file", m.path)
+			}
+
+			keep := policy == ConflictSkip || (policy == ConflictNewer && existing != nil && !e.modTime.After(existing.ModTime()))
+
+			switch {
+			case policy == ConflictFail:
+				conflicts = append(conflicts, e.name)
+			case keep:
+				report.Skipped = append(report.Skipped, e.name)
+				continue
+			case policy == ConflictRename:
+				if m.path, err = renamedPath(m.path, taken); err != nil {
+					return err
+				}
+				rel, err := filepath.Rel(s.target, m.path)
+				if err != nil {
+					return err
+				}
+				report.Renamed[e.name] = filepath.ToSlash(rel)
+			default:
+				m.replace = existing != nil
+				report.Overwritten = append(report.Overwritten, e.name)
+			}
+		}
+
+		taken[m.path] = true
+		moves = append(moves, m)
+	}
+
+	if len(conflicts) > 0 {
+		return &ConflictError{Names: conflicts}
+	}
+
+	// Then move them, undoing the moves made so far on failure.
+	for _, m := range moves {
+		if err := s.move(m.path, filepath.Join(s.dataDir(), m.rel), m.stagedEntry, m.replace); err != nil {
+			s.rollback()
+			return err
+		}
+	}
+
+	if err := s.setDirModes(); err != nil {
+		s.rollback()
+		return err
+	}
+
+	return nil
+}
+
+// move moves the staged file or creates the directory at path for the entry
+// e, first moving the file at path out of the way if replace is set.
+func (s *staging) move(path string, staged string, e stagedEntry, replace bool) error {
+	if err := s.mkdirAll(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	if e.isDir {
+		if missingDir(path) == "" {
+			return nil
+		}
+		if err := os.Mkdir(path, 0700); err != nil {
+			return err
+		}
+		s.created = append(s.created, path)
+		s.modes[path] = e.mode
+		if s.owner && os.Geteuid() == 0 {
+			return os.Lchown(path, e.uid, e.gid)
+		}
+		return nil
+	}
+
+	m := movedEntry{path: path}
+
+	if replace {
+		if s.replaced == 0 {
+			if err := os.Mkdir(filepath.Join(s.dir, "replaced"), 0700); err != nil {
+				return err
+			}
+		}
+		m.backup = filepath.Join(s.dir, "replaced", strconv.Itoa(s.replaced))
+		s.replaced++
+
+		if err := os.Rename(path, m.backup); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(staged, path); err != nil {
+		if m.backup != "" {
+			os.Rename(m.backup, path)
+		}
+		return err
+	}
+
+	s.moved = append(s.moved, m)
+
+	return nil
+}
+
+// mkdirAll creates the directory dir along with any missing parents, writable
+// by the owner only until setDirModes gives them the permissions dirMode.
+func (s *staging) mkdirAll(dir string) error {
+	missing, err := mkdirAll(dir, 0700)
+	if missing == "" {
+		return err
+	}
+	s.created = append(s.created, missing)
+
+	for p := dir; ; p = filepath.Dir(p) {
+		s.modes[p] = s.dirMode
+		if p == missing {
+			return err
+		}
+	}
+}
+
+// setDirModes gives the directories created their permissions, deepest first,
+// so that none is made read-only before those inside it.
+func (s *staging) setDirModes() error {
+	paths := make([]string, 0, len(s.modes))
+	for path := range s.modes {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool { return len(paths[i]) > len(paths[j]) })
+
+	for _, path := range paths {
+		if err := os.Chmod(path, s.modes[path]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// restoreDirTimes gives the directory entries in the target directory their
+// modification times from the package, once all files have been moved into
+// them.
+func (s *staging) restoreDirTimes() error {
+	for _, e := range s.entries {
+		if !e.isDir {
+			continue
+		}
+		if err := os.Chtimes(filepath.Join(s.target, e.rel), e.modTime, e.modTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// restoreTargetTime gives the target directory its modification time from the
+// package again, if it has a directory entry and held the staging directory,
+// whose removal changed it.
+func (s *staging) restoreTargetTime() error {
+	if !s.inside {
+		return nil
+	}
+
+	for _, e := range s.entries {
+		if e.isDir && e.rel == "." {
+			return os.Chtimes(s.target, e.modTime, e.modTime)
+		}
+	}
+
+	return nil
+}
+
+// rollback removes the entries moved into the target directory, restoring
+// the files they replaced, and the directories created, ignoring errors.
+func (s *staging) rollback() {
+	for path := range s.modes {
+		os.Chmod(path, 0700)
+	}
+
+	for i := len(s.moved) - 1; i >= 0; i-- {
+		m := s.moved[i]
+		os.Remove(m.path)
+		if m.backup != "" {
+			os.Rename(m.backup, m.path)
+		}
+	}
+	s.moved = nil
+
+	removeAll(s.created)
+	s.created = nil
+}
+
+// cleanup removes the staging directory, rolling back the Unpack first if it
+// failed. It may be called more than once, but once the staging directory and
+// the files replaced in it are gone, the Unpack is no longer rolled back.
+func (s *staging) cleanup(failed bool) {
+	if failed {
+		s.rollback()
+	}
+	if s.dir != "" {
+		os.RemoveAll(s.dir)
+		s.dir = ""
+	}
+	s.moved = nil
+	s.created = nil
+	s.modes = nil
+}
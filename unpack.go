@@ -2,98 +2,173 @@ package datapackage
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
-	"compress/gzip"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
-	"strings"
 
 	"golang.org/x/crypto/openpgp"
+	pgperrors "golang.org/x/crypto/openpgp/errors"
 )
 
 // next advances to the next file in the package, which will be read on the
 // next call to DataPackage.Read.
-func (d *DataPackage) next() (*tar.Header, error) {
+func (d *DataPackage) next() (hdr *tar.Header, err error) {
 	// The `tar` package panics on Next when there is nothing in the reader.
 	// This most often happens when the binary is invoked with no arguments and
 	// nothing on STDIN.
 	defer func() {
 		if r := recover(); r != nil {
-			log.Fatalf("packer: panic while attempting to get next file in package; see `%s -h` for usage", os.Args[0])
+			hdr, err = nil, fmt.Errorf("error reading next file in package: %v", r)
 		}
 	}()
 
-	return d.tarReader.Next()
+	return d.archiveReader.Next()
 }
 
 // read reads from the current file in the package.
 func (d *DataPackage) read(b []byte) (int, error) {
-	return d.tarReader.Read(b)
+	return d.archiveReader.Read(b)
 }
 
-// finishUnpack closes the Unpack operation.
+// finishUnpack closes every open layer of the package reader, even if closing
+// one of them fails, and returns the first error.
 func (d *DataPackage) finishUnpack() error {
-	if err := d.inReadCloser.Close(); err != nil {
-		return err
+	var err error
+
+	if c, ok := d.archiveReader.(io.Closer); ok {
+		err = c.Close()
 	}
-	if d.keyReader != nil {
-		if err := d.keyReader.Close(); err != nil {
-			return err
+	d.archiveReader = nil
+
+	if d.compReadCloser != nil {
+		if cerr := d.compReadCloser.Close(); err == nil {
+			err = cerr
 		}
+		d.compReadCloser = nil
 	}
-	return nil
+
+	if d.inReadCloser != nil {
+		if cerr := d.inReadCloser.Close(); err == nil {
+			err = cerr
+		}
+		d.inReadCloser = nil
+	}
+
+	return err
 }
 
-// makeDecryptingReader creates a decrypting reader based on the passed reader
-// using the passed config and returns an io.ReadCloser to read from and close.
-func (d *DataPackage) makeDecryptingReader() (io.Reader, error) {
+// makeDecryptingReader reads the OpenPGP message from in, decrypting it with
+// whichever private key in the keyring it is encrypted to (if it is encrypted)
+// and preparing to check its signature against the trusted signers (if
+// given). It returns an io.Reader of the message body.
+func (d *DataPackage) makeDecryptingReader(in io.Reader) (io.Reader, error) {
 
 	var (
-		passReader       io.Reader
-		passFile         *os.File
-		decryptingReader io.Reader
-		err              error
+		keyring openpgp.EntityList
+		err     error
 	)
 
-	d.keyReader, err = os.Open(d.KeyPath)
-	if err != nil {
+	if keyring, err = d.decryptionKeys(); err != nil {
 		return nil, err
 	}
 
-	passReader = strings.NewReader("")
-
-	if d.KeyPassPath != "" {
-
-		if passFile, err = os.Open(d.KeyPassPath); err != nil {
+	if d.TrustedSignersPath != "" {
+		if d.trustedSigners, err = readKeyRingFile(d.TrustedSignersPath); err != nil {
 			return nil, err
 		}
+	}
 
-		defer passFile.Close()
+	if d.msgDetails, err = readMessage(in, keyring, d.keyPassphrase, d.trustedSigners); err != nil {
+		return nil, err
+	}
 
-		passReader = io.Reader(passFile)
+	if d.msgDetails.DecryptedWith.Entity != nil {
+		d.DecryptedBy = identify(d.msgDetails.DecryptedWith.Entity)
 	}
 
-	// TODO: shouldn't the env variables be resolved by something else and stuffed into the Config object?
-	if os.Getenv("PACKER_KEYPASS") != "" {
-		passReader = strings.NewReader(os.Getenv("PACKER_KEYPASS"))
+	return &stickyEOFReader{r: d.msgDetails.UnverifiedBody}, nil
+}
+
+// stickyEOFReader returns io.EOF without reading from r once r has returned
+// it. OpenPGP checks the signature when the message body first reaches EOF and
+// overwrites the result on every later read.
+type stickyEOFReader struct {
+	r   io.Reader
+	eof bool
+}
+
+func (s *stickyEOFReader) Read(b []byte) (int, error) {
+	if s.eof {
+		return 0, io.EOF
 	}
 
-	if decryptingReader, err = decrypt(d.inReadCloser, d.keyReader, passReader); err != nil {
-		return nil, err
+	n, err := s.r.Read(b)
+	if err == io.EOF {
+		s.eof = true
 	}
 
-	return decryptingReader, nil
+	return n, err
 }
 
-// Unpack writes files from a package reader to the output directory.
-func (d *DataPackage) Unpack(dataDirPath string) error {
+// verifySignature drains the rest of the OpenPGP message, which completes the
+// signature check, and then requires a good signature by one of the trusted
+// signers. It does nothing unless TrustedSignersPath is given, and a package
+// that is not an OpenPGP message at all is unsigned.
+func (d *DataPackage) verifySignature() error {
 
-	var err error
+	if d.TrustedSignersPath == "" {
+		return nil
+	}
+
+	if d.msgDetails == nil {
+		return &SignatureError{Err: ErrUnsigned}
+	}
+
+	if _, err := io.Copy(ioutil.Discard, d.encReader); err != nil {
+		return err
+	}
+
+	md := d.msgDetails
+	keyID := fmt.Sprintf("%016X", md.SignedByKeyId)
+
+	switch {
+	case !md.IsSigned:
+		return &SignatureError{Err: ErrUnsigned}
+	case md.SignedBy == nil || len(d.trustedSigners.KeysById(md.SignedByKeyId)) == 0:
+		return &SignatureError{KeyID: keyID, Err: ErrUntrustedSigner}
+	case md.SignatureError != nil:
+		return &SignatureError{KeyID: keyID, Err: md.SignatureError}
+	}
+
+	d.SignedBy = identify(md.SignedBy.Entity)
+
+	return nil
+}
+
+// openReader opens the package file or STDIN and layers decryption and
+// signature checking (if it is an OpenPGP message), decompression and tar or
+// ZIP reading on top of it.
+func (d *DataPackage) openReader() error {
+
+	var (
+		comp Compression
+		err  error
+	)
+
+	d.inReadCloser = nil
+	d.compReadCloser = nil
+	d.archiveReader = nil
+	d.encReader = nil
+	d.msgDetails = nil
+	d.trustedSigners = nil
+	d.SignedBy = nil
+	d.DecryptedBy = nil
 
 	if d.PackagePath != "" {
 
@@ -109,154 +184,342 @@ func (d *DataPackage) Unpack(dataDirPath string) error {
 
 	}
 
-	// Add decryption to the reader if necessary.
-	if d.KeyPath != "" {
+	// Count the package bytes read, for UnpackLimits.MaxRatio.
+	d.inCounter = &countingReader{r: d.inReadCloser}
+	in := bufio.NewReader(d.inCounter)
 
-		if d.encReader, err = d.makeDecryptingReader(); err != nil {
-			return fmt.Errorf("makeDecryptingReader() failed: %v", err)
+	// Add decryption and signature checking to the reader if the package is
+	// an OpenPGP message, whether it is encrypted, signed or both. This is
+	// decided from its contents rather than its extension or the keys given.
+	head, err := in.Peek(tarMagicOffset + 5)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	if isOpenPGP(head) {
+
+		if d.encReader, err = d.makeDecryptingReader(in); err != nil {
+			return fmt.Errorf("makeDecryptingReader() failed: %w", err)
 		}
 	}
 
 	// Add decompression to the reader.
 	if d.encReader != nil {
-		if d.gzipReader, err = gzip.NewReader(d.encReader); err != nil {
-			return err
-		}
-		d.tarReader = tar.NewReader(d.gzipReader)
+		d.compReadCloser, comp, err = newDecompressor(d.encReader)
 	} else {
-		if d.gzipReader, err = gzip.NewReader(d.inReadCloser); err != nil {
+		d.compReadCloser, comp, err = newDecompressor(in)
+	}
+	if err != nil {
+		return err
+	}
+
+	// A ZIP package file that is neither encrypted nor compressed is read in
+	// place rather than copied.
+	var inPlace *os.File
+	if f, ok := d.inReadCloser.(*os.File); ok && d.encReader == nil && comp == CompressionNone {
+		if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+			inPlace = f
+			d.inCounter.n = fi.Size()
+		}
+	}
+
+	if d.archiveReader, err = newArchiveReader(d.compReadCloser, inPlace, &limiter{limits: d.Limits, in: d.inCounter}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// isOpenPGP reports whether head, the start of a package, is the header of an
+// OpenPGP packet that can begin an encrypted or signed message, rather than a
+// tar header or the magic bytes of a codec or ZIP archive.
+func isOpenPGP(head []byte) bool {
+	if len(head) == 0 || head[0]&0x80 == 0 {
+		return false
+	}
+	if len(head) == tarMagicOffset+5 && bytes.HasPrefix(head[tarMagicOffset:], []byte("ustar")) {
+		return false
+	}
+
+	// New format headers hold the tag in the low six bits, old format ones in
+	// the four bits above the length type.
+	tag := head[0] & 0x3f
+	if head[0]&0x40 == 0 {
+		tag = tag >> 2
+	}
+
+	switch tag {
+	case 1, 2, 3, 4, 8, 11: // Session keys, signatures, compressed or literal data.
+		return true
+	}
+
+	return false
+}
+
+// Unpack writes files from a package reader to the output directory. If the
+// package carries a manifest, every extracted file is checked against it and
+// a *ManifestError is returned on the first mismatch or missing file. If the
+// package exceeds the Limits, a *LimitError is returned.
+//
+// The package is extracted into a hidden staging directory next to the output
+// directory and only moved into place once it has been read to the end and
+// verified. If the output directory does not exist yet, the staging directory
+// takes its place as a whole. Otherwise the files are moved into it one by
+// one, so the commit is per file rather than all at once: another process
+// watching the output directory sees each file appear complete, but may see
+// some files of the package before others. Only if the parent of an existing
+// output directory is not writable is the staging directory created inside
+// it. If Unpack fails, the output directory is left as it was.
+//
+// Files that already exist in the output directory are handled according to
+// OnConflict. By default, Unpack checks every entry and returns a
+// *ConflictError listing those that exist, without moving anything. The
+// outcome for every entry is recorded in Unpacked.
+func (d *DataPackage) Unpack(dataDirPath string) error {
+	return d.UnpackContext(context.Background(), dataDirPath)
+}
+
+// UnpackContext is like Unpack, but stops once ctx is done, checking between
+// files and while copying them, in which case it closes the package, removes
+// the staging directory and returns the context's error.
+func (d *DataPackage) UnpackContext(ctx context.Context, dataDirPath string) (err error) {
+
+	var (
+		r      *PackageReader
+		policy ConflictPolicy
+	)
+
+	d.ctx = ctx
+	defer func() { d.ctx = nil }()
+
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	if policy, err = d.conflictPolicy(); err != nil {
+		return err
+	}
+
+	report := &UnpackReport{Renamed: make(map[string]string)}
+	d.Unpacked = report
+
+	// The package reader checks every extracted file against the manifest
+	// once it is reached.
+	if r, err = NewPackageReader(d); err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	// The total size of the files is known up front only for ZIP packages.
+	total := int64(-1)
+	if s, ok := d.archiveReader.(sizedArchive); ok {
+		total = s.totalSize()
+	}
+	d.progress = newProgress(d.Progress, "unpack", total)
+
+	if dataDirPath == "" {
+		if dataDirPath, err = os.Getwd(); err != nil {
 			return err
 		}
-		d.tarReader = tar.NewReader(d.gzipReader)
 	}
 
+	// Extract into a staging directory in or next to the output directory,
+	// which is removed again whatever happens, and roll back on failure.
+	stage, err := newStaging(filepath.Clean(dataDirPath), d.dirMode(0))
+	if err != nil {
+		return err
+	}
+	stage.owner = d.RestoreOwner
+
+	defer func() { stage.cleanup(err != nil) }()
+
+	root := stage.dataDir()
+
 	for {
 
 		var (
-			fileHeader *tar.Header
-			filePath   string
-			fileDir    string
-			fileInfo   os.FileInfo
-			file       *os.File
-			buf        []byte
-			err        error
+			entry    *Entry
+			filePath string
+			fileDir  string
+			err      error
 		)
 
-		// Advance to next file in the reader or exit with success if there are
-		// no more.
-		if fileHeader, err = d.next(); err == io.EOF {
+		// Advance to next file in the reader or, if there are no more and the
+		// signature is trusted and the files match the manifest, move them
+		// into place.
+		if entry, err = r.Next(); err == io.EOF {
+			if err = r.Close(); err != nil {
+				return err
+			}
+			if err = stage.commit(policy, report); err != nil {
+				return err
+			}
+			// Directory times are restored while the files replaced can
+			// still be moved back, should that fail.
+			if d.RestoreModTime {
+				if err = stage.restoreDirTimes(); err != nil {
+					return err
+				}
+			}
+			// Once the staging directory is removed the Unpack has
+			// succeeded, so failures from here on are only logged.
+			stage.cleanup(false)
+			if d.RestoreModTime {
+				if err := stage.restoreTargetTime(); err != nil {
+					d.logger().Warn("restoring directory time", "file", ".", "error", err, "phase", "unpack")
+				}
+			}
 			return nil
 		}
 		if err != nil {
 			return err
 		}
 
-		if dataDirPath == "" {
-			if dataDirPath, err = os.Getwd(); err != nil {
-				return err
-			}
+		// Refuse entries that would be written outside the directory, and
+		// links and devices unless they are allowed.
+		if filePath, err = d.entryPath(root, entry.header); err != nil {
+			return err
 		}
-
-		filePath = filepath.Join(dataDirPath, fileHeader.Name)
 		fileDir = filepath.Dir(filePath)
-		fileInfo = fileHeader.FileInfo()
 
-		// Make directories in file path.
-		if err = os.MkdirAll(fileDir, 0766); err != nil {
+		rel, err := filepath.Rel(root, filePath)
+		if err != nil {
 			return err
 		}
+		stage.add(rel, entry.header, d.dirMode(entry.Mode))
 
-		// Open file for writing.
-		if file, err = os.OpenFile(filePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, fileInfo.Mode()); err != nil {
+		// Make directories in file path, which get their permissions once
+		// the package has been moved into place.
+		if _, err = mkdirAll(fileDir, 0700); err != nil {
 			return err
 		}
-		defer file.Close()
-
-		// Write file from the package reader.
-		log.Printf("packer: unpacking '%s'", filepath.Base(fileHeader.Name))
-
-		buf = make([]byte, 32*1024)
 
-		for {
-			nr, er := d.read(buf)
-			if nr > 0 {
-				nw, ew := file.Write(buf[0:nr])
-				if ew != nil {
-					err = ew
-					break
-				}
-				if nr != nw {
-					err = errors.New("short write")
-					break
-				}
+		// Create directories, links and devices, which have no contents.
+		switch entry.header.Typeflag {
+		case tar.TypeDir:
+			if _, err = mkdirAll(filePath, 0700); err != nil {
+				return err
+			}
+			if err = d.restoreOwner(filePath, entry.header); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeSymlink:
+			if err = os.Symlink(entry.Linkname, filePath); err != nil {
+				return err
+			}
+			if err = d.restoreOwner(filePath, entry.header); err != nil {
+				return err
 			}
-			if er == io.EOF {
-				break
+			continue
+		case tar.TypeLink:
+			if err = os.Link(filepath.Join(root, entry.Linkname), filePath); err != nil {
+				return err
 			}
-			if er != nil {
-				err = er
-				break
+			continue
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			if err = mknod(filePath, entry.header); err != nil {
+				return err
+			}
+			if err = d.setMetadata(filePath, entry.header, d.fileMode(entry.Mode)); err != nil {
+				return err
 			}
+			continue
 		}
 
-		if err != nil {
+		// Write file from the package reader.
+		d.logger().Info("unpacking file", "file", entry.Name, "size", entry.Size, "phase", "unpack")
+		d.progress.start(entry.Name, entry.Size)
+
+		if err = d.extractFile(r, filePath, d.fileMode(entry.Mode)); err != nil {
+			return err
+		}
+		if err = d.setMetadata(filePath, entry.header, d.fileMode(entry.Mode)); err != nil {
 			return err
 		}
 	}
+}
 
-	if err = d.finishUnpack(); err != nil {
+// extractFile writes the current file in r to a new file at filePath with the
+// given mode, and syncs and closes it before returning.
+func (d *DataPackage) extractFile(r *PackageReader, filePath string, mode os.FileMode) (err error) {
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
 		return err
 	}
-	return nil
-}
 
-// decrypt takes a reader with encrypted data, a reader with the private key,
-// and a reader with the passphrase (or an empty string if the key is
-// unprotected) and returns an io.ReadCloser that decrypts the data. It assumes
-// there is only one OpenPGP entity involved.
-func decrypt(encReader io.Reader, keyReader io.Reader, passReader io.Reader) (io.Reader, error) {
+	defer func() {
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+	}()
 
-	var (
-		entityList openpgp.EntityList
-		entity     *openpgp.Entity
-		passphrase []byte
-		msgDetails *openpgp.MessageDetails
-		err        error
-	)
+	buf := make([]byte, 32*1024)
 
-	// Read armored private key into entityList.
-	if entityList, err = openpgp.ReadArmoredKeyRing(keyReader); err != nil {
-		return nil, err
+	for {
+		nr, er := r.Read(buf)
+		if nr > 0 {
+			nw, ew := file.Write(buf[0:nr])
+			d.progress.add(nw)
+			if ew != nil {
+				return ew
+			}
+			if nr != nw {
+				return errors.New("short write")
+			}
+		}
+		if er == io.EOF {
+			break
+		}
+		if er != nil {
+			return er
+		}
 	}
 
-	entity = entityList[0]
+	return file.Sync()
+}
 
-	// Decode entity private key and subkey private keys. This assumes there is
-	// only one entity involved.
-	if passphrase, err = ioutil.ReadAll(passReader); err != nil {
-		return nil, err
-	}
+// readMessage takes a reader with an OpenPGP message, a keyring of private
+// keys (empty if the message is only signed), a function returning the
+// passphrase of a private key and the public keys of trusted signers, and
+// returns the details of the message for reading its body. Only the keys the
+// message is encrypted to are unlocked.
+func readMessage(encReader io.Reader, keyring openpgp.EntityList, keyPassphrase func(openpgp.Key) ([]byte, error), trustedSigners openpgp.EntityList) (*openpgp.MessageDetails, error) {
 
-	passphrase = bytes.TrimSpace(passphrase)
+	// OpenPGP calls prompt with the still locked private keys that match the
+	// recipients of the message until one of them is unlocked.
+	prompt := func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
 
-	if entity.PrivateKey != nil && entity.PrivateKey.Encrypted {
-		if err = entity.PrivateKey.Decrypt(passphrase); err != nil {
-			return nil, err
-		}
-	}
+		var lastErr error
+
+		for _, key := range keys {
 
-	for _, subkey := range entity.Subkeys {
-		if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
-			if err = subkey.PrivateKey.Decrypt(passphrase); err != nil {
+			passphrase, err := keyPassphrase(key)
+			if err != nil {
 				return nil, err
 			}
+
+			if lastErr = key.PrivateKey.Decrypt(passphrase); lastErr == nil {
+				return nil, nil
+			}
 		}
+
+		if lastErr != nil {
+			return nil, fmt.Errorf("error unlocking private key: %v", lastErr)
+		}
+
+		return nil, ErrNoMatchingKey
 	}
 
-	// Create decrypted message reader.
-	if msgDetails, err = openpgp.ReadMessage(encReader, entityList, nil, nil); err != nil {
-		return nil, err
+	// Create message reader, which can also check signatures by any of the
+	// trusted signers.
+	keyring = append(keyring[:len(keyring):len(keyring)], trustedSigners...)
+
+	msgDetails, err := openpgp.ReadMessage(encReader, keyring, prompt, nil)
+	if err == pgperrors.ErrKeyIncorrect {
+		return nil, ErrNoMatchingKey
 	}
 
-	return msgDetails.UnverifiedBody, nil
+	return msgDetails, err
 }
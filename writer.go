@@ -0,0 +1,305 @@
+package datapackage
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// PackageWriter writes files into a package one at a time, from any
+// io.Reader, without staging them on disk. Like Pack, it records every file
+// in the manifest (and the descriptor, if WriteDescriptor is set), which are
+// written when the PackageWriter is closed.
+//
+// A PackageWriter keeps its state in the DataPackage it is created for, so
+// only one may be in use per DataPackage at a time. Once an error leaves the
+// package incomplete, it is abandoned and every later call returns that error.
+type PackageWriter struct {
+	d      *DataPackage
+	cur    *entryWriter
+	closed bool
+	err    error // Error the package was abandoned for.
+}
+
+// NewPackageWriter opens the package at d.PackagePath (or STDOUT) for writing,
+// with the encryption, signing, container and compression d specifies. The
+// package is written to a temporary file next to PackagePath until it is
+// closed, and PackagePath must not exist. The descriptor, if any, is named
+// after the package file.
+func NewPackageWriter(d *DataPackage) (*PackageWriter, error) {
+	d.outWriteCloser = nil
+	d.tempFile = nil
+	d.encWriteCloser = nil
+	d.compWriteCloser = nil
+	d.archiveWriter = nil
+	d.sourceDate = time.Time{}
+
+	if d.Reproducible {
+		var err error
+		if d.sourceDate, err = sourceDateEpoch(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := d.openWriter(); err != nil {
+		d.abortPack()
+		return nil, err
+	}
+
+	// Start a fresh manifest, which finishPack writes as the last entry, and
+	// a descriptor if one was requested.
+	d.manifest = new(Manifest)
+	d.descriptor = nil
+	d.progress = newProgress(d.Progress, "pack", -1)
+
+	if d.WriteDescriptor {
+		name := "datapackage"
+		if d.PackagePath != "" {
+			name = filepath.Base(d.PackagePath)
+			if i := strings.IndexByte(name, '.'); i > 0 {
+				name = name[:i]
+			}
+		}
+		d.descriptor = &Descriptor{
+			Profile:   "tabular-data-package",
+			Name:      descriptorName(name),
+			Resources: []Resource{},
+		}
+	}
+
+	return &PackageWriter{d: d}, nil
+}
+
+// Create adds a file to the package with the given slash-separated name, size
+// and modification time, and returns a writer for its contents. Exactly size
+// bytes must be written before the next call to Create, AddFile or Close. The
+// name may not be absolute, leave the package root or be that of the
+// manifest or descriptor.
+func (w *PackageWriter) Create(name string, size int64, modTime time.Time) (io.Writer, error) {
+	return w.create(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+	})
+}
+
+// AddFile adds the file at path to the package under its base name.
+func (w *PackageWriter) AddFile(path string) error {
+	return w.addFile(path, filepath.Base(path))
+}
+
+// addFile adds the file at path to the package as name, with the mode and
+// modification time of the file.
+func (w *PackageWriter) addFile(path string, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("'%s' is not a regular file", path)
+	}
+
+	// Create tar.Header from file info, adding the path.
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+
+	hdr.Name = filepath.ToSlash(name)
+
+	dst, err := w.create(hdr)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 32*1024)
+
+	for {
+		if err = w.d.context().Err(); err != nil {
+			return w.abort(err)
+		}
+
+		nr, er := f.Read(buf)
+		if nr > 0 {
+			nw, ew := dst.Write(buf[0:nr])
+			if ew != nil {
+				return w.abort(ew)
+			}
+			if nr != nw {
+				return w.abort(errors.New("short write"))
+			}
+		}
+		if er == io.EOF {
+			break
+		}
+		if er != nil {
+			return w.abort(er)
+		}
+	}
+
+	if err = w.finishEntry(); err != nil {
+		return w.abort(err)
+	}
+
+	return nil
+}
+
+// create finishes the current entry and writes the header of the next.
+func (w *PackageWriter) create(hdr *tar.Header) (io.Writer, error) {
+	if w.err != nil {
+		return nil, w.err
+	}
+	if w.closed {
+		return nil, errors.New("package writer is closed")
+	}
+
+	if err := w.finishEntry(); err != nil {
+		return nil, w.abort(err)
+	}
+
+	rel, ok := localPath(hdr.Name)
+	if !ok {
+		return nil, fmt.Errorf("invalid package path '%s'", hdr.Name)
+	}
+	hdr.Name = filepath.ToSlash(rel)
+
+	if hdr.Name == ManifestName || (w.d.descriptor != nil && hdr.Name == DescriptorName) {
+		return nil, fmt.Errorf("'%s' is reserved", hdr.Name)
+	}
+	if hdr.Size < 0 {
+		return nil, fmt.Errorf("'%s' has negative size %d", hdr.Name, hdr.Size)
+	}
+
+	if w.d.Reproducible {
+		w.d.normalizeHeader(hdr)
+	}
+
+	// Call the WriteHeader method, which prepares the already existing
+	// writer to receive another file.
+	if err := w.d.archiveWriter.WriteHeader(hdr); err != nil {
+		return nil, w.abort(err)
+	}
+
+	w.cur = &entryWriter{d: w.d, name: hdr.Name, size: hdr.Size, hash: sha256.New()}
+	w.d.progress.start(hdr.Name, hdr.Size)
+
+	return w.cur, nil
+}
+
+// finishEntry checks that the current entry, if any, was written in full and
+// records it in the manifest and descriptor.
+func (w *PackageWriter) finishEntry() error {
+	e := w.cur
+	if e == nil {
+		return nil
+	}
+
+	w.cur = nil
+
+	if e.written != e.size {
+		return fmt.Errorf("'%s' is %d bytes, expected %d", e.name, e.written, e.size)
+	}
+
+	sum := hex.EncodeToString(e.hash.Sum(nil))
+
+	w.d.manifest.Files = append(w.d.manifest.Files, ManifestFile{
+		Path:   e.name,
+		Size:   e.size,
+		SHA256: sum,
+	})
+
+	if w.d.descriptor != nil && strings.EqualFold(filepath.Ext(e.name), ".csv") {
+		resource, err := newResource(e.name, e.head, e.size, sum)
+		if err != nil {
+			return err
+		}
+		w.d.descriptor.addResource(resource)
+	}
+
+	return nil
+}
+
+// Close finishes the last file, writes the descriptor (if requested) and the
+// manifest, and closes the package, flushing any unwritten data. The package
+// file only appears at PackagePath once it is complete, and is never created
+// if Close fails.
+func (w *PackageWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.closed {
+		return nil
+	}
+
+	w.closed = true
+
+	// The package is unusable without the last entry, so abandon it.
+	if err := w.finishEntry(); err != nil {
+		return w.abort(err)
+	}
+
+	if err := w.d.finishPack(); err != nil {
+		return w.abort(err)
+	}
+
+	return nil
+}
+
+// abort abandons the package, which err has left incomplete, and returns err,
+// which every later call returns as well.
+func (w *PackageWriter) abort(err error) error {
+	w.d.abortPack()
+	w.cur = nil
+	w.err = err
+	return err
+}
+
+// entryWriter writes the contents of a package entry, hashing them for the
+// manifest and keeping the start of them for the descriptor.
+type entryWriter struct {
+	d       *DataPackage
+	name    string
+	size    int64
+	written int64
+	hash    hash.Hash
+	head    []byte
+}
+
+func (e *entryWriter) Write(b []byte) (int, error) {
+	if e.written+int64(len(b)) > e.size {
+		return 0, fmt.Errorf("'%s' is longer than %d bytes", e.name, e.size)
+	}
+
+	n, err := e.d.write(b)
+
+	e.hash.Write(b[:n])
+	e.written += int64(n)
+	e.d.progress.add(n)
+
+	if len(e.head) < headerSizeMax {
+		rest := headerSizeMax - len(e.head)
+		if rest > n {
+			rest = n
+		}
+		e.head = append(e.head, b[:rest]...)
+	}
+
+	return n, err
+}